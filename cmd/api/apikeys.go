@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"golang.org/x/time/rate"
+)
+
+// API key scopes.
+const (
+	scopeUpload = "upload"
+	scopeRead   = "read"
+	scopeAdmin  = "admin"
+)
+
+var validScopes = map[string]bool{scopeUpload: true, scopeRead: true, scopeAdmin: true}
+
+// APIKey is a row of the api_keys table. The key itself is never stored,
+// only its SHA-256 hash.
+type APIKey struct {
+	ID                string          `db:"id" json:"id"`
+	Name              string          `db:"name" json:"name"`
+	KeyHash           string          `db:"key_hash" json:"-"`
+	KeyPrefix         string          `db:"key_prefix" json:"key_prefix"`
+	Scopes            pq.StringArray  `db:"scopes" json:"scopes"`
+	MonthlyMaxCalls   sql.NullInt64   `db:"monthly_max_calls" json:"-"`
+	MonthlyMaxCostUSD sql.NullFloat64 `db:"monthly_max_cost_usd" json:"-"`
+	RequestsPerMinute sql.NullInt64   `db:"requests_per_minute" json:"-"`
+	CreatedAt         time.Time       `db:"created_at" json:"created_at"`
+	ExpiresAt         sql.NullTime    `db:"expires_at" json:"-"`
+	RevokedAt         sql.NullTime    `db:"revoked_at" json:"-"`
+}
+
+const apiKeyColumns = "id, name, key_hash, key_prefix, scopes, monthly_max_calls, monthly_max_cost_usd, requests_per_minute, created_at, expires_at, revoked_at"
+
+func (k APIKey) active(now time.Time) bool {
+	if k.RevokedAt.Valid {
+		return false
+	}
+	return !k.ExpiresAt.Valid || k.ExpiresAt.Time.After(now)
+}
+
+func (k APIKey) response() gin.H {
+	response := gin.H{
+		"id":         k.ID,
+		"name":       k.Name,
+		"key_prefix": k.KeyPrefix,
+		"scopes":     k.Scopes,
+		"created_at": k.CreatedAt,
+		"active":     k.active(time.Now()),
+	}
+	if k.ExpiresAt.Valid {
+		response["expires_at"] = k.ExpiresAt.Time
+	}
+	if k.RevokedAt.Valid {
+		response["revoked_at"] = k.RevokedAt.Time
+	}
+	if k.MonthlyMaxCalls.Valid {
+		response["monthly_max_calls"] = k.MonthlyMaxCalls.Int64
+	}
+	if k.MonthlyMaxCostUSD.Valid {
+		response["monthly_max_cost_usd"] = k.MonthlyMaxCostUSD.Float64
+	}
+	if k.RequestsPerMinute.Valid {
+		response["requests_per_minute"] = k.RequestsPerMinute.Int64
+	}
+	return response
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticate resolves a bearer token to its API key, looked up by the
+// SHA-256 of the token. The key configured in API_AUTH_KEY acts as a
+// bootstrap key with every scope and no rate limit.
+func authenticate(ctx context.Context, token string) (APIKey, bool, error) {
+	if apiAuthKey != "" && subtle.ConstantTimeCompare([]byte(token), []byte(apiAuthKey)) == 1 {
+		return APIKey{ID: defaultAPIKeyID, Scopes: []string{scopeUpload, scopeRead, scopeAdmin}}, true, nil
+	}
+
+	hash := hashAPIKey(token)
+	var key APIKey
+	err := db.GetContext(ctx, &key, "SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = $1", hash)
+	if err == sql.ErrNoRows {
+		return APIKey{}, false, nil
+	}
+	if err != nil {
+		return APIKey{}, false, err
+	}
+	if !key.active(time.Now()) {
+		return APIKey{}, false, nil
+	}
+	return key, true, nil
+}
+
+// keyLimiters holds a token bucket per rate-limited API key, refilled at the
+// key's requests_per_minute with a burst of one minute of requests. Buckets
+// live in the memory of each API replica and are not shared: with N
+// replicas behind a load balancer a key may make up to N times its
+// requests_per_minute.
+type keyLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]*keyLimiter
+}
+
+type keyLimiter struct {
+	perMinute int64
+	limiter   *rate.Limiter
+}
+
+var requestLimiters = &keyLimiters{limiters: make(map[string]*keyLimiter)}
+
+// allow takes a request from the key's bucket. When the bucket is empty it
+// returns false and how long until a request is allowed.
+func (l *keyLimiters) allow(key APIKey) (bool, time.Duration) {
+	if !key.RequestsPerMinute.Valid {
+		return true, 0
+	}
+	perMinute := key.RequestsPerMinute.Int64
+	if perMinute <= 0 {
+		return false, time.Minute
+	}
+
+	l.mu.Lock()
+	kl, ok := l.limiters[key.ID]
+	// A changed limit starts a new, full bucket.
+	if !ok || kl.perMinute != perMinute {
+		kl = &keyLimiter{perMinute: perMinute, limiter: rate.NewLimiter(rate.Limit(float64(perMinute)/60), int(perMinute))}
+		l.limiters[key.ID] = kl
+	}
+	l.mu.Unlock()
+
+	r := kl.limiter.Reserve()
+	if delay := r.Delay(); delay > 0 {
+		r.Cancel()
+		return false, delay
+	}
+	return true, 0
+}
+
+// rateLimited responds 429 with a Retry-After of wait, rounded up to seconds.
+func rateLimited(c *gin.Context, wait time.Duration) {
+	seconds := int64(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", strconv.FormatInt(seconds, 10))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "API key rate limit exceeded", "retry_after_seconds": seconds})
+}
+
+// requireScope aborts requests whose API key lacks the scope. The admin scope
+// grants every other scope.
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasScope(c, scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key lacks the '" + scope + "' scope"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func hasScope(c *gin.Context, scope string) bool {
+	for _, s := range c.GetStringSlice("scopes") {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+type createAPIKeyRequest struct {
+	Name              string     `json:"name" binding:"required"`
+	Scopes            []string   `json:"scopes" binding:"required"`
+	ExpiresAt         *time.Time `json:"expires_at"`
+	MonthlyMaxCalls   *int64     `json:"monthly_max_calls"`
+	MonthlyMaxCostUSD *float64   `json:"monthly_max_cost_usd"`
+	RequestsPerMinute *int64     `json:"requests_per_minute"`
+}
+
+func handleCreateAPIKey(c *gin.Context) {
+	var req createAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if len(req.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one scope is required"})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !validScopes[scope] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown scope: " + scope})
+			return
+		}
+	}
+
+	if req.RequestsPerMinute != nil && *req.RequestsPerMinute <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "requests_per_minute must be positive"})
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		logger.Error("Failed to generate API key", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate API key"})
+		return
+	}
+	plainKey := "pk_" + base64.RawURLEncoding.EncodeToString(secret)
+
+	key := APIKey{
+		ID:        uuid.New().String(),
+		Name:      req.Name,
+		KeyHash:   hashAPIKey(plainKey),
+		KeyPrefix: plainKey[:12],
+		Scopes:    req.Scopes,
+		CreatedAt: time.Now(),
+	}
+	if req.ExpiresAt != nil {
+		key.ExpiresAt = sql.NullTime{Time: *req.ExpiresAt, Valid: true}
+	}
+	if req.MonthlyMaxCalls != nil {
+		key.MonthlyMaxCalls = sql.NullInt64{Int64: *req.MonthlyMaxCalls, Valid: true}
+	}
+	if req.MonthlyMaxCostUSD != nil {
+		key.MonthlyMaxCostUSD = sql.NullFloat64{Float64: *req.MonthlyMaxCostUSD, Valid: true}
+	}
+	if req.RequestsPerMinute != nil {
+		key.RequestsPerMinute = sql.NullInt64{Int64: *req.RequestsPerMinute, Valid: true}
+	}
+
+	_, err := db.NamedExecContext(c.Request.Context(), `INSERT INTO api_keys (id, name, key_hash, key_prefix, scopes, monthly_max_calls, monthly_max_cost_usd, requests_per_minute, created_at, expires_at)
+		VALUES (:id, :name, :key_hash, :key_prefix, :scopes, :monthly_max_calls, :monthly_max_cost_usd, :requests_per_minute, :created_at, :expires_at)`, key)
+	if err != nil {
+		logger.Error("Failed to create API key", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	logger.Info("Created API key", "api_key_id", key.ID, "name", key.Name, "created_by", c.GetString("api_key_id"))
+	response := key.response()
+	// The plain key is only ever returned here.
+	response["key"] = plainKey
+	c.JSON(http.StatusCreated, response)
+}
+
+func handleListAPIKeys(c *gin.Context) {
+	var keys []APIKey
+	err := db.SelectContext(c.Request.Context(), &keys, "SELECT "+apiKeyColumns+" FROM api_keys ORDER BY created_at DESC")
+	if err != nil {
+		logger.Error("Failed to list API keys", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list API keys"})
+		return
+	}
+
+	response := make([]gin.H, 0, len(keys))
+	for _, key := range keys {
+		response = append(response, key.response())
+	}
+	c.JSON(http.StatusOK, gin.H{"api_keys": response})
+}
+
+func handleRevokeAPIKey(c *gin.Context) {
+	keyID := c.Param("key_id")
+	if _, err := uuid.Parse(keyID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+
+	result, err := db.ExecContext(c.Request.Context(), "UPDATE api_keys SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL", time.Now(), keyID)
+	if err != nil {
+		logger.Error("Failed to revoke API key", "api_key_id", keyID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found or already revoked"})
+		return
+	}
+
+	logger.Info("Revoked API key", "api_key_id", keyID, "revoked_by", c.GetString("api_key_id"))
+	c.JSON(http.StatusOK, gin.H{"id": keyID, "revoked": true})
+}
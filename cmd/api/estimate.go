@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+
+	"github.com/gin-gonic/gin"
+
+	"processador-de-enderecos/internal/address"
+	"processador-de-enderecos/pkg/googlemaps"
+)
+
+// CostEstimate is the expected Google usage of a CSV file, computed without
+// calling Google.
+type CostEstimate struct {
+	Rows             int                   `json:"rows"`
+	UniqueAddresses  int                   `json:"unique_addresses"`
+	CachedAddresses  int                   `json:"cached_addresses"`
+	APICalls         googlemaps.CallCounts `json:"estimated_api_calls"`
+	EstimatedCostUSD float64               `json:"estimated_cost_usd"`
+	Prices           googlemaps.PriceTable `json:"price_table_usd_per_1000"`
+}
+
+// estimateCost reads the addresses of a CSV file from its first column,
+// skipping the first line if header is set, deduplicates them and checks the
+// place cache. The call counts are upper bounds: Nearby Search and Place
+// Details are only called when the previous step finds something.
+func estimateCost(ctx context.Context, src io.Reader, header bool) (*CostEstimate, error) {
+	csvReader := csv.NewReader(src)
+	csvReader.FieldsPerRecord = -1
+	csvReader.ReuseRecord = true
+
+	if header {
+		_, _ = csvReader.Read()
+	}
+
+	estimate := &CostEstimate{Prices: prices}
+	seen := make(map[string]bool)
+	var keys []string
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		estimate.Rows++
+		key := address.Key(record[0])
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	estimate.UniqueAddresses = len(keys)
+
+	if len(keys) > 0 {
+		hits, err := placeCache.CountHits(ctx, keys)
+		if err != nil {
+			return nil, err
+		}
+		estimate.CachedAddresses = hits
+	}
+
+	toResolve := int64(estimate.UniqueAddresses - estimate.CachedAddresses)
+	estimate.APICalls = googlemaps.CallCounts{
+		Geocode:      toResolve,
+		NearbySearch: toResolve,
+		PlaceDetails: toResolve,
+	}
+	estimate.EstimatedCostUSD = prices.Cost(estimate.APICalls)
+	return estimate, nil
+}
+
+// jobProgress formats the row counters of a job.
+func jobProgress(job Job) gin.H {
+	progress := gin.H{"rows_processed": job.RowsProcessed}
+	if job.RowsTotal.Valid {
+		progress["rows_total"] = job.RowsTotal.Int64
+	}
+	return progress
+}
+
+// jobUsage formats the recorded Google usage of a job.
+func jobUsage(job Job) gin.H {
+	usage := gin.H{
+		"api_calls": googlemaps.CallCounts{
+			Geocode:      job.GeocodeCalls,
+			NearbySearch: job.NearbySearchCalls,
+			PlaceDetails: job.PlaceDetailsCalls,
+		},
+		"cache_hits": job.CacheHits,
+		"cost_usd":   job.CostUSD,
+	}
+	budget := gin.H{}
+	if job.MaxCalls.Valid {
+		budget["max_calls"] = job.MaxCalls.Int64
+	}
+	if job.MaxCostUSD.Valid {
+		budget["max_cost_usd"] = job.MaxCostUSD.Float64
+	}
+	if len(budget) > 0 {
+		usage["budget"] = budget
+	}
+	// How the workers' adaptive rate limiter treated the job
+	if job.RateStats.Valid {
+		usage["rate_limit"] = json.RawMessage(job.RateStats.String)
+	}
+	return usage
+}
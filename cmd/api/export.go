@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"processador-de-enderecos/internal/decompress"
+	"processador-de-enderecos/internal/jobs"
+	"processador-de-enderecos/internal/output"
+)
+
+// handleGetJobResult streams the result of a job, converting the stored JSONL
+// on the fly to the format requested in ?format=.
+func handleGetJobResult(c *gin.Context) {
+	jobID := c.Param("job_id")
+	format := c.DefaultQuery("format", output.FormatJSONL)
+	contentType, ok := output.ContentTypes[format]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be one of csv, jsonl, geojson, ndjson.gz"})
+		return
+	}
+
+	var job Job
+	if err := getJob(c, &job, jobID); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+			return
+		}
+		logger.Error("Failed to get job from database", "job_id", jobID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get job"})
+		return
+	}
+	if job.Status == jobs.Expired {
+		c.JSON(http.StatusGone, gin.H{"error": "Job data expired after the retention period"})
+		return
+	}
+	if !job.ResultPath.Valid {
+		c.JSON(http.StatusConflict, gin.H{"error": "Job has no result yet", "status": job.Status})
+		return
+	}
+	// Retry jobs can export the parent result with the retried rows replaced.
+	resultPath := job.ResultPath.String
+	if merged, _ := strconv.ParseBool(c.Query("merged")); merged {
+		if !job.MergedResultPath.Valid {
+			c.JSON(http.StatusConflict, gin.H{"error": "Job has no merged result", "status": job.Status})
+			return
+		}
+		resultPath = job.MergedResultPath.String
+	}
+
+	object, err := resultStore.Get(c.Request.Context(), resultPath)
+	if err != nil {
+		logger.Error("Failed to get result from storage", "job_id", jobID, "path", resultPath, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read result"})
+		return
+	}
+	defer object.Close()
+
+	var inputColumns []string
+	if format == output.FormatCSV {
+		inputColumns = uploadHeader(c.Request.Context(), &job)
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", `attachment; filename="`+jobID+"."+format+`"`)
+	c.Status(http.StatusOK)
+	if err := output.Export(c.Writer, object, format, inputColumns); err != nil {
+		// Headers are already sent, so the client sees a truncated body.
+		logger.Error("Failed to export result", "job_id", jobID, "format", format, "error", err)
+	}
+}
+
+// uploadHeader reads the header row of a job's upload. It returns nil if the
+// upload has no header or can't be read.
+func uploadHeader(ctx context.Context, job *Job) []string {
+	if !job.HasHeader {
+		return nil
+	}
+	objectName := jobInputPath(job)
+	object, err := uploadStore.Get(ctx, objectName)
+	if err != nil {
+		return nil
+	}
+	defer object.Close()
+
+	rc, _, err := decompress.NewReader(object, object.Info().Size, maxDecompressedBytes)
+	if err != nil {
+		logger.Warn("Failed to open upload", "job_id", job.ID, "object", objectName, "error", err)
+		return nil
+	}
+	defer rc.Close()
+
+	csvReader := csv.NewReader(rc)
+	csvReader.FieldsPerRecord = -1
+	header, err := csvReader.Read()
+	if err != nil {
+		logger.Warn("Failed to read upload header", "job_id", job.ID, "object", objectName, "error", err)
+		return nil
+	}
+	return header
+}
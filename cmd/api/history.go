@@ -0,0 +1,50 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handleGetJobHistory lists the status changes of a job, oldest first.
+func handleGetJobHistory(c *gin.Context) {
+	jobID := c.Param("job_id")
+
+	var job Job
+	if err := getJob(c, &job, jobID); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+			return
+		}
+		logger.Error("Failed to get job from database", "job_id", jobID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get job"})
+		return
+	}
+
+	events, err := jobRepo.History(c.Request.Context(), job.ID)
+	if err != nil {
+		logger.Error("Failed to get job history", "job_id", job.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get job history"})
+		return
+	}
+
+	history := make([]gin.H, len(events))
+	for i, e := range events {
+		event := gin.H{
+			"status":     e.ToStatus,
+			"created_at": e.CreatedAt,
+		}
+		if e.FromStatus.Valid {
+			event["from_status"] = e.FromStatus.String
+		}
+		if e.WorkerID.Valid {
+			event["worker_id"] = e.WorkerID.String
+		}
+		if e.Message.Valid {
+			event["message"] = e.Message.String
+		}
+		history[i] = event
+	}
+	c.JSON(http.StatusOK, gin.H{"job_id": job.ID, "status": job.Status, "history": history})
+}
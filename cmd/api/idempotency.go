@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// errIdempotencyKeyReused is returned when an Idempotency-Key is sent again
+// with a different file.
+var errIdempotencyKeyReused = errors.New("Idempotency-Key was already used with a different file")
+
+const (
+	matchedByIdempotencyKey = "idempotency_key"
+	matchedByContentHash    = "content_sha256"
+)
+
+// contentSHA256 hashes an input file without moving its read position.
+func contentSHA256(src io.ReaderAt, size int64) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(src, 0, size)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// idempotencyKey reads the optional Idempotency-Key header.
+func idempotencyKey(c *gin.Context) (sql.NullString, error) {
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" {
+		return sql.NullString{}, nil
+	}
+	if len(key) > 255 {
+		return sql.NullString{}, errors.New("Idempotency-Key must be at most 255 characters")
+	}
+	return sql.NullString{String: key, Valid: true}, nil
+}
+
+// findExistingJob looks for a job of the calling API key that a submission
+// duplicates: first by Idempotency-Key, then, unless allowDuplicate is set,
+// by content hash among the jobs created within idempotencyWindow. Failed and
+// expired jobs are not matched by content so that they can be resubmitted.
+func findExistingJob(c *gin.Context, key sql.NullString, sum string, allowDuplicate bool) (*Job, string, error) {
+	ctx := c.Request.Context()
+	apiKeyID := c.GetString("api_key_id")
+
+	var job Job
+	if key.Valid {
+		err := db.GetContext(ctx, &job, "SELECT "+jobColumns+" FROM jobs WHERE api_key_id = $1 AND idempotency_key = $2", apiKeyID, key.String)
+		if err == nil {
+			if job.ContentSHA256.Valid && job.ContentSHA256.String != sum {
+				return &job, matchedByIdempotencyKey, errIdempotencyKeyReused
+			}
+			return &job, matchedByIdempotencyKey, nil
+		}
+		if err != sql.ErrNoRows {
+			return nil, "", err
+		}
+	}
+	if allowDuplicate {
+		return nil, "", nil
+	}
+
+	err := db.GetContext(ctx, &job, "SELECT "+jobColumns+" FROM jobs WHERE api_key_id = $1 AND content_sha256 = $2 AND created_at > $3 AND status NOT IN ('FAILED', 'CANCELLED', 'EXPIRED') ORDER BY created_at DESC LIMIT 1",
+		apiKeyID, sum, time.Now().Add(-idempotencyWindow))
+	if err == sql.ErrNoRows {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return &job, matchedByContentHash, nil
+}
+
+// respondExistingJob answers a duplicate submission with the job it matched,
+// or with an error if the Idempotency-Key was reused with another file.
+func respondExistingJob(c *gin.Context, job *Job, matchedBy string, err error) {
+	if errors.Is(err, errIdempotencyKeyReused) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "job_id": job.ID})
+		return
+	}
+	logger.Info("Returning existing job for duplicate submission", "job_id", job.ID, "matched_by", matchedBy)
+	c.Header("Idempotent-Replayed", "true")
+	c.JSON(http.StatusOK, gin.H{
+		"job_id":     job.ID,
+		"status":     job.Status,
+		"duplicate":  true,
+		"matched_by": matchedBy,
+		"progress":   jobProgress(*job),
+	})
+}
+
+// isUniqueViolation reports whether err is a PostgreSQL unique constraint
+// violation.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
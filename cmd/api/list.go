@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 200
+)
+
+// encodeCursor builds the opaque pagination cursor pointing after a job.
+func encodeCursor(job Job) string {
+	raw := job.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + job.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	createdAt, id, found := strings.Cut(string(raw), "|")
+	if !found {
+		return time.Time{}, "", fmt.Errorf("malformed cursor")
+	}
+	t, err := time.Parse(time.RFC3339Nano, createdAt)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		return time.Time{}, "", err
+	}
+	return t, id, nil
+}
+
+// handleListJobs returns the caller's jobs, newest first by default, using
+// keyset pagination on (created_at, id).
+func handleListJobs(c *gin.Context) {
+	conditions := []string{"api_key_id = $1"}
+	args := []interface{}{c.GetString("api_key_id")}
+	addArg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if v := c.Query("status"); v != "" {
+		conditions = append(conditions, "status = ANY("+addArg(pq.Array(strings.Split(strings.ToUpper(v), ",")))+")")
+	}
+	if v := c.Query("label"); v != "" {
+		conditions = append(conditions, "label = "+addArg(v))
+	}
+	for param, op := range map[string]string{"created_after": ">=", "created_before": "<"} {
+		v := c.Query(param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": param + " must be an RFC 3339 timestamp"})
+			return
+		}
+		conditions = append(conditions, "created_at "+op+" "+addArg(t))
+	}
+
+	order := "DESC"
+	switch c.DefaultQuery("sort", "-created_at") {
+	case "-created_at":
+	case "created_at":
+		order = "ASC"
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be created_at or -created_at"})
+		return
+	}
+
+	limit := defaultListLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxListLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxListLimit)})
+			return
+		}
+		limit = n
+	}
+
+	if v := c.Query("cursor"); v != "" {
+		createdAt, id, err := decodeCursor(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		op := "<"
+		if order == "ASC" {
+			op = ">"
+		}
+		conditions = append(conditions, "(created_at, id) "+op+" ("+addArg(createdAt)+", "+addArg(id)+")")
+	}
+
+	// Fetch one extra row to know whether there is a next page.
+	query := "SELECT " + jobColumns + " FROM jobs WHERE " + strings.Join(conditions, " AND ") +
+		" ORDER BY created_at " + order + ", id " + order + " LIMIT " + addArg(limit+1)
+
+	var jobs []Job
+	if err := db.SelectContext(c.Request.Context(), &jobs, query, args...); err != nil {
+		logger.Error("Failed to list jobs", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list jobs"})
+		return
+	}
+
+	response := gin.H{}
+	if len(jobs) > limit {
+		jobs = jobs[:limit]
+		response["next_cursor"] = encodeCursor(jobs[limit-1])
+	}
+	items := make([]gin.H, 0, len(jobs))
+	for _, job := range jobs {
+		item := gin.H{
+			"job_id":     job.ID,
+			"status":     job.Status,
+			"created_at": job.CreatedAt,
+			"updated_at": job.UpdatedAt,
+			"progress":   jobProgress(job),
+			"usage":      jobUsage(job),
+		}
+		if job.Label.Valid {
+			item["label"] = job.Label.String
+		}
+		items = append(items, item)
+	}
+	response["jobs"] = items
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"processador-de-enderecos/internal/processor"
+)
+
+const (
+	// maxLookupAddresses caps the addresses accepted by a single lookup.
+	maxLookupAddresses = 25
+	// lookupConcurrency is the number of addresses of a lookup resolved at once.
+	lookupConcurrency = 5
+)
+
+type lookupRequest struct {
+	Address   string   `json:"address"`
+	Addresses []string `json:"addresses"`
+}
+
+// handleLookup matches one address, or a small array of addresses, inline
+// with the same pipeline and place cache used by batch jobs.
+func handleLookup(c *gin.Context) {
+	if matcher == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Lookups are disabled: GOOGLE_MAPS_API_KEY is not set"})
+		return
+	}
+
+	var req lookupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	single := req.Address != ""
+	addresses := req.Addresses
+	if single {
+		addresses = []string{req.Address}
+	}
+	if len(addresses) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "address or addresses is required"})
+		return
+	}
+	if len(addresses) > maxLookupAddresses {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At most 25 addresses per lookup; submit a job for larger lists"})
+		return
+	}
+	for _, address := range addresses {
+		if strings.TrimSpace(address) == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Addresses must not be empty"})
+			return
+		}
+	}
+
+	// Lookups count towards the monthly caps of the caller's API key.
+	keyBudget, err := processor.LoadKeyBudget(c.Request.Context(), db, prices, monthlyLimits, c.GetString("api_key_id"))
+	if err != nil {
+		logger.Error("Failed to load API key budget", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load API key budget"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), lookupTimeout)
+	defer cancel()
+	start := time.Now()
+	records, calls, budgetErr := matcher.Lookup(ctx, addresses, lookupConcurrency, keyBudget)
+
+	status := http.StatusOK
+	switch {
+	case budgetErr != nil:
+		// Rows refused by the budget are marked BUDGET_EXCEEDED.
+		status = http.StatusTooManyRequests
+	case ctx.Err() == context.DeadlineExceeded:
+		// Rows that didn't finish in time carry the deadline error.
+		status = http.StatusGatewayTimeout
+	}
+	logger.Info("Address lookup", "api_key_id", c.GetString("api_key_id"), "addresses", len(addresses), "api_calls", calls.Total(), "duration", time.Since(start))
+
+	response := gin.H{
+		"usage": gin.H{
+			"api_calls": calls,
+			"cost_usd":  prices.Cost(calls),
+		},
+	}
+	if budgetErr != nil {
+		response["error"] = budgetErr.Error()
+	}
+	if single {
+		response["result"] = records[0]
+	} else {
+		response["results"] = records
+	}
+	c.JSON(status, response)
+}
@@ -1,40 +1,94 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"log/slog"
+	"math"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
-	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
-	"github.com/streadway/amqp"
+	"golang.org/x/time/rate"
+
+	"processador-de-enderecos/internal/cache"
+	"processador-de-enderecos/internal/csvcheck"
+	"processador-de-enderecos/internal/decompress"
+	"processador-de-enderecos/internal/jobs"
+	"processador-de-enderecos/internal/messages"
+	"processador-de-enderecos/internal/migrate"
+	"processador-de-enderecos/internal/outbox"
+	"processador-de-enderecos/internal/processor"
+	"processador-de-enderecos/internal/rabbitmq"
+	"processador-de-enderecos/internal/ratelimit"
+	"processador-de-enderecos/internal/storage"
+	"processador-de-enderecos/pkg/googlemaps"
 )
 
 var (
 	db          *sqlx.DB
-	minioClient *minio.Client
-	rabbitCh    *amqp.Channel
-	apiAuthKey  string
-	logger      *slog.Logger
+	jobRepo     *jobs.Repository
+	uploadStore storage.Store
+	resultStore storage.Store
+	// relay publishes the job messages stored in the outbox.
+	relay      *outbox.Relay
+	apiAuthKey string
+	placeCache *cache.PlaceCache
+	prices     googlemaps.PriceTable
+	// matcher serves synchronous lookups; nil when GOOGLE_MAPS_API_KEY is unset.
+	matcher       *processor.Matcher
+	lookupTimeout time.Duration
+	// monthlyLimits caps the Google usage of each API key, lookups included.
+	monthlyLimits processor.MonthlyLimits
+	// maxUploadBytes caps files uploaded through presigned URLs.
+	maxUploadBytes int64
+	// maxDecompressedBytes caps the decompressed size of compressed inputs.
+	maxDecompressedBytes int64
+	uploadURLExpiry      time.Duration
+	// idempotencyWindow is how long identical uploads map to the same job.
+	idempotencyWindow time.Duration
+	logger            *slog.Logger
 )
 
 type Job struct {
-	ID           string         `db:"id"`
-	Status       string         `db:"status"`
-	ResultPath   sql.NullString `db:"result_path"`
-	ErrorMessage sql.NullString `db:"error_message"`
-	CreatedAt    time.Time      `db:"created_at"`
-	UpdatedAt    time.Time      `db:"updated_at"`
+	ID                string          `db:"id"`
+	Status            jobs.Status     `db:"status"`
+	InputPath         sql.NullString  `db:"input_path"`
+	ResultPath        sql.NullString  `db:"result_path"`
+	MergedResultPath  sql.NullString  `db:"merged_result_path"`
+	ErrorMessage      sql.NullString  `db:"error_message"`
+	APIKeyID          sql.NullString  `db:"api_key_id"`
+	Label             sql.NullString  `db:"label"`
+	IdempotencyKey    sql.NullString  `db:"idempotency_key"`
+	ContentSHA256     sql.NullString  `db:"content_sha256"`
+	ParentJobID       sql.NullString  `db:"parent_job_id"`
+	RowsTotal         sql.NullInt64   `db:"rows_total"`
+	HasHeader         bool            `db:"has_header"`
+	RowsProcessed     int64           `db:"rows_processed"`
+	MaxCalls          sql.NullInt64   `db:"max_calls"`
+	MaxCostUSD        sql.NullFloat64 `db:"max_cost_usd"`
+	GeocodeCalls      int64           `db:"geocode_calls"`
+	NearbySearchCalls int64           `db:"nearby_search_calls"`
+	PlaceDetailsCalls int64           `db:"place_details_calls"`
+	CacheHits         int64           `db:"cache_hits"`
+	CostUSD           float64         `db:"cost_usd"`
+	RateStats         sql.NullString  `db:"rate_stats"`
+	CreatedAt         time.Time       `db:"created_at"`
+	UpdatedAt         time.Time       `db:"updated_at"`
 }
 
+const jobColumns = "id, status, input_path, result_path, merged_result_path, error_message, api_key_id, label, idempotency_key, content_sha256, parent_job_id, rows_total, has_header, rows_processed, max_calls, max_cost_usd, geocode_calls, nearby_search_calls, place_details_calls, cache_hits, cost_usd, rate_stats, created_at, updated_at"
+
 func main() {
 	var err error
 	// Initialize structured logger
@@ -43,10 +97,37 @@ func main() {
 	// Config
 	dbDSN := os.Getenv("DB_DSN")
 	rabbitmqURL := os.Getenv("RABBITMQ_URL")
-	minioEndpoint := os.Getenv("MINIO_ENDPOINT")
-	minioAccessKeyID := os.Getenv("MINIO_ACCESS_KEY_ID")
-	minioSecretAccessKey := os.Getenv("MINIO_SECRET_ACCESS_KEY")
 	apiAuthKey = os.Getenv("API_AUTH_KEY")
+	prices = googlemaps.PriceTableFromEnv()
+	googleMapsAPIKey := os.Getenv("GOOGLE_MAPS_API_KEY")
+	lookupQPS, err := strconv.ParseFloat(os.Getenv("LOOKUP_QPS"), 64)
+	if err != nil || lookupQPS <= 0 {
+		lookupQPS = 10
+	}
+	// Monthly Google usage caps per API key, shared with the worker; empty
+	// means unlimited
+	monthlyLimits.MaxCalls, _ = strconv.ParseInt(os.Getenv("MONTHLY_MAX_CALLS"), 10, 64)
+	monthlyLimits.MaxCostUSD, _ = strconv.ParseFloat(os.Getenv("MONTHLY_MAX_COST_USD"), 64)
+	lookupTimeout, err = time.ParseDuration(os.Getenv("LOOKUP_TIMEOUT"))
+	if err != nil || lookupTimeout <= 0 {
+		lookupTimeout = 10 * time.Second
+	}
+	maxUploadBytes, err = strconv.ParseInt(os.Getenv("MAX_UPLOAD_BYTES"), 10, 64)
+	if err != nil || maxUploadBytes <= 0 {
+		maxUploadBytes = 1 << 30 // 1GB
+	}
+	maxDecompressedBytes, err = strconv.ParseInt(os.Getenv("MAX_DECOMPRESSED_BYTES"), 10, 64)
+	if err != nil || maxDecompressedBytes <= 0 {
+		maxDecompressedBytes = 4 << 30 // 4GB
+	}
+	idempotencyWindow, err = time.ParseDuration(os.Getenv("IDEMPOTENCY_WINDOW"))
+	if err != nil || idempotencyWindow < 0 {
+		idempotencyWindow = 24 * time.Hour
+	}
+	uploadURLExpiry, err = time.ParseDuration(os.Getenv("UPLOAD_URL_EXPIRY"))
+	if err != nil || uploadURLExpiry <= 0 {
+		uploadURLExpiry = time.Hour
+	}
 
 	// PostgreSQL
 	db, err = sqlx.Connect("postgres", dbDSN)
@@ -55,53 +136,120 @@ func main() {
 		log.Fatalf("Failed to connect to PostgreSQL: %v", err)
 	}
 
-	// RabbitMQ
-	conn, err := amqp.Dial(rabbitmqURL)
+	// Schema migrations: "migrate [up|down [steps]|version]" runs them and
+	// exits; otherwise pending ones are applied at startup.
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate.Run(context.Background(), db.DB, os.Args[2:], logger); err != nil {
+			logger.Error("Failed to run migrations", "error", err)
+			log.Fatalf("Failed to run migrations: %v", err)
+		}
+		return
+	}
+	if autoMigrate, err := strconv.ParseBool(os.Getenv("AUTO_MIGRATE")); err != nil || autoMigrate {
+		applied, err := migrate.Up(context.Background(), db.DB)
+		if err != nil {
+			logger.Error("Failed to apply migrations", "error", err)
+			log.Fatalf("Failed to apply migrations: %v", err)
+		}
+		for _, m := range applied {
+			logger.Info("Applied migration", "version", m.Version, "name", m.Name)
+		}
+	}
+	hostname, _ := os.Hostname()
+	jobRepo = jobs.NewRepository(db, fmt.Sprintf("api/%s-%d", hostname, os.Getpid()))
+
+	placeCacheTTL, err := time.ParseDuration(os.Getenv("PLACE_CACHE_TTL"))
+	if err != nil {
+		placeCacheTTL = 30 * 24 * time.Hour
+	}
+	placeCache = cache.NewPlaceCache(db, placeCacheTTL)
+
+	// Google Maps Client for synchronous lookups. Its calls share the
+	// request rates of the workers through PostgreSQL, unless
+	// RATE_LIMIT_BACKEND=local: the API then has its own limiter, and
+	// LOOKUP_QPS must be left out of the QPS given to the workers.
+	if googleMapsAPIKey != "" {
+		var limiter googlemaps.Limiter
+		if os.Getenv("RATE_LIMIT_BACKEND") == "local" {
+			limiter = googlemaps.SharedLimiter(rate.NewLimiter(rate.Limit(lookupQPS), int(math.Ceil(lookupQPS))))
+		} else {
+			// While PostgreSQL is unreachable each replica allows its share
+			replicas, err := strconv.Atoi(os.Getenv("RATE_LIMIT_REPLICAS"))
+			if err != nil || replicas <= 0 {
+				replicas = 1
+			}
+			limiter = ratelimit.NewPostgres(db, googlemaps.RatesFromEnv(), replicas, logger)
+		}
+		matcher = processor.NewMatcher(googlemaps.NewClient(googleMapsAPIKey, limiter), placeCache, logger)
+	}
+
+	// RabbitMQ. The client reconnects on its own when the connection drops.
+	rabbit, err := rabbitmq.Dial(rabbitmqURL, rabbitmq.DeclareTopology, logger)
 	if err != nil {
 		logger.Error("Failed to connect to RabbitMQ", "error", err)
 		log.Fatalf("Failed to connect to RabbitMQ: %v", err)
 	}
-	defer conn.Close()
+	defer rabbit.Close()
 
-	rabbitCh, err = conn.Channel()
-	if err != nil {
-		logger.Error("Failed to open a RabbitMQ channel", "error", err)
-		log.Fatalf("Failed to open a channel: %v", err)
-	}
-	defer rabbitCh.Close()
-
-	_, err = rabbitCh.QueueDeclare(
-		"jobs.queue", // name
-		true,         // durable
-		false,        // delete when unused
-		false,        // exclusive
-		false,        // no-wait
-		nil,          // arguments
-	)
-	if err != nil {
-		logger.Error("Failed to declare a RabbitMQ queue", "error", err)
-		log.Fatalf("Failed to declare a queue: %v", err)
+	// Outbox relay: publishes committed jobs to the queue
+	relayInterval, err := time.ParseDuration(os.Getenv("OUTBOX_POLL_INTERVAL"))
+	if err != nil || relayInterval <= 0 {
+		relayInterval = time.Second
 	}
+	relay = outbox.NewRelay(jobRepo, rabbit, relayInterval, logger)
+	go relay.Run(context.Background())
 
-	// MinIO
-	minioClient, err = minio.New(minioEndpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(minioAccessKeyID, minioSecretAccessKey, ""),
-		Secure: false,
-	})
+	// Object storage (MinIO/S3 or a local directory)
+	storageConfig := storage.ConfigFromEnv()
+	uploadStore, resultStore, err = storage.Open(storageConfig)
 	if err != nil {
-		logger.Error("Failed to connect to MinIO", "error", err)
-		log.Fatalf("Failed to connect to MinIO: %v", err)
+		logger.Error("Failed to configure object storage", "error", err)
+		log.Fatalf("Failed to configure object storage: %v", err)
+	}
+
+	// Retention: expire the files and result rows of old jobs
+	retention, _ := time.ParseDuration(os.Getenv("RETENTION_PERIOD"))
+	if retention > 0 {
+		sweepInterval, err := time.ParseDuration(os.Getenv("RETENTION_SWEEP_INTERVAL"))
+		if err != nil || sweepInterval <= 0 {
+			sweepInterval = time.Hour
+		}
+		go runRetentionSweeper(context.Background(), retention, sweepInterval)
 	}
 
 	// Gin
 	router := gin.Default()
+	if storageConfig.Backend == "local" {
+		// Presigned URLs of the local backend are served by the API itself.
+		files := http.StripPrefix("/files", storage.LocalHandler(storageConfig.Dir, []byte(storageConfig.Secret), maxUploadBytes))
+		router.GET("/files/*path", gin.WrapH(files))
+		router.PUT("/files/*path", gin.WrapH(files))
+	}
 	v1 := router.Group("/api/v1")
 	v1.Use(authMiddleware())
 	{
 		jobs := v1.Group("/jobs")
 		{
-			jobs.POST("/upload", handleUploadCSV)
-			jobs.GET("/:job_id", handleGetJobStatus)
+			jobs.GET("", requireScope(scopeRead), handleListJobs)
+			jobs.POST("", requireScope(scopeUpload), handleCreateJob)
+			jobs.POST("/upload", requireScope(scopeUpload), handleUploadCSV)
+			jobs.POST("/uploads", requireScope(scopeUpload), handleCreateUpload)
+			jobs.POST("/:job_id/start", requireScope(scopeUpload), handleStartJob)
+			jobs.POST("/:job_id/retry-failed", requireScope(scopeUpload), handleRetryFailed)
+			jobs.GET("/:job_id", requireScope(scopeRead), handleGetJobStatus)
+			jobs.GET("/:job_id/history", requireScope(scopeRead), handleGetJobHistory)
+			jobs.DELETE("/:job_id", requireScope(scopeUpload), handleDeleteJob)
+			jobs.GET("/:job_id/result", requireScope(scopeRead), handleGetJobResult)
+			jobs.GET("/:job_id/results", requireScope(scopeRead), handleListJobResults)
+		}
+
+		v1.POST("/lookup", requireScope(scopeUpload), handleLookup)
+
+		admin := v1.Group("/admin", requireScope(scopeAdmin))
+		{
+			admin.POST("/api-keys", handleCreateAPIKey)
+			admin.GET("/api-keys", handleListAPIKeys)
+			admin.DELETE("/api-keys/:key_id", handleRevokeAPIKey)
 		}
 	}
 
@@ -109,6 +257,28 @@ func main() {
 	router.Run(":8080")
 }
 
+// getJob loads a job owned by the caller's API key. Admin keys can read every
+// job; other tenants' jobs are reported as not found.
+func getJob(c *gin.Context, job *Job, jobID string) error {
+	if _, err := uuid.Parse(jobID); err != nil {
+		return sql.ErrNoRows
+	}
+	return db.GetContext(c.Request.Context(), job, "SELECT "+jobColumns+" FROM jobs WHERE id = $1 AND (api_key_id = $2 OR $3)",
+		jobID, c.GetString("api_key_id"), hasScope(c, scopeAdmin))
+}
+
+// jobInputPath is the object name of a job's input file in the uploads bucket.
+// Jobs created before input_path was recorded always used uploads/<id>.csv.
+func jobInputPath(job *Job) string {
+	if job.InputPath.Valid {
+		return job.InputPath.String
+	}
+	return "uploads/" + job.ID + ".csv"
+}
+
+// defaultAPIKeyID identifies the key configured in API_AUTH_KEY.
+const defaultAPIKeyID = "default"
+
 func authMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
@@ -124,11 +294,25 @@ func authMiddleware() gin.HandlerFunc {
 		}
 
 		token := authHeader[len(bearerPrefix):]
-		if token != apiAuthKey {
+		key, ok, err := authenticate(c.Request.Context(), token)
+		if err != nil {
+			logger.Error("Failed to look up API key", "error", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+			return
+		}
+		if !ok {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
 			return
 		}
 
+		if allowed, wait := requestLimiters.allow(key); !allowed {
+			rateLimited(c, wait)
+			return
+		}
+
+		// Jobs and budgets are accounted per API key.
+		c.Set("api_key_id", key.ID)
+		c.Set("scopes", []string(key.Scopes))
 		c.Next()
 	}
 }
@@ -141,18 +325,16 @@ func handleUploadCSV(c *gin.Context) {
 		return
 	}
 
-	if file.Header.Get("Content-Type") != "text/csv" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "File must be a CSV"})
-		return
-	}
-
 	if file.Size > 10*1024*1024 { // 10MB
 		c.JSON(http.StatusBadRequest, gin.H{"error": "File size exceeds 10MB"})
 		return
 	}
 
-	jobID := uuid.New()
-	objectName := "uploads/" + jobID.String() + ".csv"
+	opts, err := parseJobOptions(func(key string) string { return c.DefaultPostForm(key, c.Query(key)) })
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	src, err := file.Open()
 	if err != nil {
@@ -162,50 +344,242 @@ func handleUploadCSV(c *gin.Context) {
 	}
 	defer src.Close()
 
-	_, err = minioClient.PutObject(c.Request.Context(), "uploads", objectName, src, file.Size, minio.PutObjectOptions{ContentType: "text/csv"})
+	// The multipart Content-Type is whatever the client claims (curl sends
+	// application/octet-stream), so validate the content itself.
+	report, format, ok := validateInput(c, src, file.Size)
+	if !ok {
+		return
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		logger.Error("Failed to rewind uploaded file", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+
+	submitJob(c, opts, report, src, file.Size, format)
+}
+
+// validateInput decompresses and validates an input file. When the file is
+// rejected it responds to the client and returns false.
+func validateInput(c *gin.Context, src decompress.Source, size int64) (*csvcheck.Report, decompress.Format, bool) {
+	rc, format, err := decompress.NewReader(src, size, maxDecompressedBytes)
 	if err != nil {
-		logger.Error("Failed to upload file to MinIO", "bucket", "uploads", "object", objectName, "error", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file"})
+		if errors.Is(err, decompress.ErrTooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Decompressed file exceeds the size limit", "max_bytes": maxDecompressedBytes})
+			return nil, format, false
+		}
+		logger.Warn("Rejected unreadable compressed upload", "format", format, "error", err)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Invalid " + string(format) + " file: " + err.Error()})
+		return nil, format, false
+	}
+	defer rc.Close()
+
+	report, err := csvcheck.Check(rc, csvcheck.Options{})
+	if err != nil {
+		if errors.Is(err, decompress.ErrTooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Decompressed file exceeds the size limit", "max_bytes": maxDecompressedBytes})
+			return nil, format, false
+		}
+		if report == nil {
+			logger.Error("Failed to read uploaded file", "format", format, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+			return nil, format, false
+		}
+		logger.Warn("Rejected invalid CSV upload", "format", format, "error", err, "bad_lines", report.BadLineCount)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Invalid CSV file: " + err.Error(), "validation": report})
+		return nil, format, false
+	}
+	return report, format, true
+}
+
+// jobOptions are the optional settings accepted when a job is submitted.
+type jobOptions struct {
+	label      sql.NullString
+	maxCalls   sql.NullInt64
+	maxCostUSD sql.NullFloat64
+	dryRun     bool
+	// allowDuplicate skips the detection of identical recent uploads.
+	allowDuplicate bool
+}
+
+// parseJobOptions reads the job settings through param, which looks them up
+// in the form or query string depending on the endpoint.
+func parseJobOptions(param func(string) string) (jobOptions, error) {
+	var opts jobOptions
+	if v := strings.TrimSpace(param("label")); v != "" {
+		if len(v) > 255 {
+			return opts, errors.New("label must be at most 255 characters")
+		}
+		opts.label = sql.NullString{String: v, Valid: true}
+	}
+
+	// Optional per-job budget
+	if v := param("max_calls"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return opts, errors.New("max_calls must be a positive integer")
+		}
+		opts.maxCalls = sql.NullInt64{Int64: n, Valid: true}
+	}
+	if v := param("max_cost_usd"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n <= 0 {
+			return opts, errors.New("max_cost_usd must be a positive number")
+		}
+		opts.maxCostUSD = sql.NullFloat64{Float64: n, Valid: true}
+	}
+
+	opts.dryRun, _ = strconv.ParseBool(param("dry_run"))
+	opts.allowDuplicate, _ = strconv.ParseBool(param("allow_duplicate"))
+	return opts, nil
+}
+
+// submitJob stores a validated input file in the uploads bucket, creates the
+// job and enqueues it, or only estimates its cost for dry runs. src must be
+// positioned at its start.
+func submitJob(c *gin.Context, opts jobOptions, report *csvcheck.Report, src decompress.Source, size int64, format decompress.Format) {
+	if opts.dryRun {
+		rc, _, err := decompress.NewReader(src, size, maxDecompressedBytes)
+		if err != nil {
+			logger.Error("Failed to reopen uploaded file", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+			return
+		}
+		defer rc.Close()
+		estimate, err := estimateCost(c.Request.Context(), rc, report.HasHeader)
+		if err != nil {
+			logger.Error("Failed to estimate job cost", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to estimate job cost"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"dry_run": true, "schema": report, "estimate": estimate})
 		return
 	}
 
-	_, err = db.ExecContext(c.Request.Context(), "INSERT INTO jobs (id, status, created_at, updated_at) VALUES ($1, $2, $3, $4)", jobID, "PENDING", time.Now(), time.Now())
+	key, err := idempotencyKey(c)
 	if err != nil {
-		logger.Error("Failed to create job in database", "job_id", jobID.String(), "error", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sum, err := contentSHA256(src, size)
+	if err != nil {
+		logger.Error("Failed to hash uploaded file", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+	existing, matchedBy, err := findExistingJob(c, key, sum, opts.allowDuplicate)
+	if existing != nil {
+		respondExistingJob(c, existing, matchedBy, err)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to look up duplicate jobs", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create job"})
 		return
 	}
 
-	jobMsg := map[string]string{
-		"job_id":      jobID.String(),
-		"caminho_csv": objectName,
+	jobID := uuid.New()
+	objectName := "uploads/" + jobID.String() + format.Extension()
+
+	_, err = uploadStore.Put(c.Request.Context(), objectName, src, size, format.ContentType())
+	if err != nil {
+		logger.Error("Failed to store uploaded file", "object", objectName, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file"})
+		return
 	}
-	msgBody, _ := json.Marshal(jobMsg)
 
-	err = rabbitCh.Publish(
-		"",           // exchange
-		"jobs.queue", // routing key
-		false,        // mandatory
-		false,        // immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        msgBody,
-		})
+	err = createJob(c, jobs.NewJob{
+		ID:             jobID.String(),
+		Status:         jobs.Pending,
+		InputPath:      objectName,
+		APIKeyID:       sql.NullString{String: c.GetString("api_key_id"), Valid: true},
+		Label:          opts.label,
+		RowsTotal:      sql.NullInt64{Int64: int64(report.RowCount), Valid: true},
+		NoHeader:       !report.HasHeader,
+		MaxCalls:       opts.maxCalls,
+		MaxCostUSD:     opts.maxCostUSD,
+		IdempotencyKey: key,
+		ContentSHA256:  sql.NullString{String: sum, Valid: true},
+	}, format)
+	if err != nil && isUniqueViolation(err) {
+		// A concurrent request with the same Idempotency-Key won the race.
+		if err := uploadStore.Delete(c.Request.Context(), objectName); err != nil {
+			logger.Warn("Failed to remove duplicate upload", "object", objectName, "error", err)
+		}
+		existing, matchedBy, err := findExistingJob(c, key, sum, true)
+		if existing != nil {
+			respondExistingJob(c, existing, matchedBy, err)
+			return
+		}
+		logger.Error("Failed to look up duplicate jobs", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create job"})
+		return
+	}
 	if err != nil {
-		logger.Error("Failed to publish job to RabbitMQ", "job_id", jobID.String(), "error", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to publish job"})
+		logger.Error("Failed to create job in database", "job_id", jobID.String(), "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create job"})
 		return
 	}
 
-	logger.Info("Successfully uploaded file and created job", "job_id", jobID.String())
-	c.JSON(http.StatusAccepted, gin.H{"job_id": jobID, "status": "PENDING"})
+	logger.Info("Successfully uploaded file and created job", "job_id", jobID.String(), "rows", report.RowCount)
+	respondJobAccepted(c, jobID.String(), report)
+}
+
+// createJob stores a job together with the outbox message that enqueues it.
+// format is the compression format of its input.
+func createJob(c *gin.Context, job jobs.NewJob, format decompress.Format) error {
+	ctx := c.Request.Context()
+	err := jobRepo.InTx(ctx, func(tx *jobs.Tx) error {
+		if err := tx.Create(ctx, job); err != nil {
+			return err
+		}
+		return outbox.EnqueueJob(ctx, tx, jobMessage(c, job, format), job.RowsTotal.Int64)
+	})
+	if err == nil {
+		relay.Notify()
+	}
+	return err
+}
+
+// jobMessage builds the queue message of a job. The request's W3C trace
+// context is passed on so the worker's logs can be correlated with it.
+func jobMessage(c *gin.Context, job jobs.NewJob, format decompress.Format) messages.JobMessage {
+	msg := messages.NewJobMessage(job.ID, job.InputPath)
+	msg.Format = format
+	msg.Tenant = job.APIKeyID.String
+	msg.Options = messages.JobOptions{
+		Label:       job.Label.String,
+		MaxCalls:    job.MaxCalls.Int64,
+		MaxCostUSD:  job.MaxCostUSD.Float64,
+		ParentJobID: job.ParentJobID.String,
+	}
+	if parent := c.GetHeader("traceparent"); parent != "" {
+		msg.Trace = &messages.Trace{Parent: parent, State: c.GetHeader("tracestate")}
+	}
+	return msg
+}
+
+// respondJobAccepted answers a request that enqueued a job.
+func respondJobAccepted(c *gin.Context, jobID string, report *csvcheck.Report) {
+	c.JSON(http.StatusAccepted, gin.H{
+		"job_id": jobID,
+		"status": jobs.Pending,
+		"schema": report,
+		"estimated_api_calls": gin.H{
+			// Every row is geocoded; Nearby Search and Place Details only
+			// run when the previous step finds something.
+			"min": report.RowCount,
+			"max": report.RowCount * 3,
+		},
+	})
 }
 
 func handleGetJobStatus(c *gin.Context) {
 	jobID := c.Param("job_id")
 
 	var job Job
-	err := db.GetContext(c.Request.Context(), &job, "SELECT * FROM jobs WHERE id = $1", jobID)
+	err := getJob(c, &job, jobID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			logger.Warn("Job not found", "job_id", jobID)
@@ -218,22 +592,41 @@ func handleGetJobStatus(c *gin.Context) {
 	}
 
 	response := gin.H{
-		"job_id": job.ID,
-		"status": job.Status,
+		"job_id":   job.ID,
+		"status":   job.Status,
+		"progress": jobProgress(job),
+		"usage":    jobUsage(job),
+	}
+	if job.Label.Valid {
+		response["label"] = job.Label.String
+	}
+	if job.ParentJobID.Valid {
+		response["parent_job_id"] = job.ParentJobID.String
 	}
 
-	if job.Status == "COMPLETED" {
+	if job.Status.HasResult() {
 		if job.ResultPath.Valid {
-			presignedURL, err := minioClient.PresignedGetObject(c.Request.Context(), "results", job.ResultPath.String, time.Second*60*60, nil) // 1 hour expiry
+			presignedURL, err := resultStore.PresignGet(c.Request.Context(), job.ResultPath.String, time.Second*60*60) // 1 hour expiry
 			if err != nil {
-				logger.Error("Failed to generate download URL", "job_id", jobID, "bucket", "results", "path", job.ResultPath.String, "error", err)
+				logger.Error("Failed to generate download URL", "job_id", jobID, "path", job.ResultPath.String, "error", err)
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate download URL"})
 				return
 			}
-			
-			response["download_url"] = presignedURL.String()
+
+			response["download_url"] = presignedURL
+		}
+		if job.MergedResultPath.Valid {
+			presignedURL, err := resultStore.PresignGet(c.Request.Context(), job.MergedResultPath.String, time.Second*60*60) // 1 hour expiry
+			if err != nil {
+				logger.Error("Failed to generate download URL", "job_id", jobID, "path", job.MergedResultPath.String, "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate download URL"})
+				return
+			}
+
+			response["merged_download_url"] = presignedURL
 		}
-	} else if job.Status == "FAILED" {
+	}
+	if job.Status == jobs.Failed || job.Status == jobs.BudgetExceeded {
 		if job.ErrorMessage.Valid {
 			response["error"] = job.ErrorMessage.String
 		}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"processador-de-enderecos/internal/jobs"
+	"processador-de-enderecos/internal/outbox"
+	"processador-de-enderecos/internal/storage"
+)
+
+// handleCreateUpload creates a job awaiting its file and returns a presigned
+// PUT URL the client uses to upload the CSV straight to MinIO.
+func handleCreateUpload(c *gin.Context) {
+	opts, err := parseJobOptions(func(key string) string { return c.DefaultPostForm(key, c.Query(key)) })
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	jobID := uuid.New().String()
+	objectName := "uploads/" + jobID + ".csv"
+
+	uploadURL, err := uploadStore.PresignPut(c.Request.Context(), objectName, uploadURLExpiry)
+	if err != nil {
+		logger.Error("Failed to presign upload URL", "object", objectName, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload URL"})
+		return
+	}
+
+	err = jobRepo.Create(c.Request.Context(), jobs.NewJob{
+		ID:         jobID,
+		Status:     jobs.AwaitingUpload,
+		InputPath:  objectName,
+		APIKeyID:   sql.NullString{String: c.GetString("api_key_id"), Valid: true},
+		Label:      opts.label,
+		MaxCalls:   opts.maxCalls,
+		MaxCostUSD: opts.maxCostUSD,
+	})
+	if err != nil {
+		logger.Error("Failed to create job in database", "job_id", jobID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create job"})
+		return
+	}
+
+	logger.Info("Created job awaiting direct upload", "job_id", jobID)
+	c.JSON(http.StatusCreated, gin.H{
+		"job_id": jobID,
+		"status": jobs.AwaitingUpload,
+		"upload": gin.H{
+			"method":     http.MethodPut,
+			"url":        uploadURL,
+			"expires_at": time.Now().Add(uploadURLExpiry),
+			"max_bytes":  maxUploadBytes,
+		},
+	})
+}
+
+type startRequest struct {
+	// MD5 and SHA256 are optional hex digests of the uploaded file.
+	MD5    string `json:"md5"`
+	SHA256 string `json:"sha256"`
+}
+
+// handleStartJob verifies a file uploaded through a presigned URL and
+// enqueues its job.
+func handleStartJob(c *gin.Context) {
+	jobID := c.Param("job_id")
+
+	var req startRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+	}
+
+	var job Job
+	if err := getJob(c, &job, jobID); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+			return
+		}
+		logger.Error("Failed to get job from database", "job_id", jobID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get job"})
+		return
+	}
+	if job.Status != jobs.AwaitingUpload {
+		c.JSON(http.StatusConflict, gin.H{"error": "Job has already been started", "status": job.Status})
+		return
+	}
+
+	objectName := jobInputPath(&job)
+	object, err := uploadStore.Get(c.Request.Context(), objectName)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusConflict, gin.H{"error": "File has not been uploaded yet"})
+			return
+		}
+		logger.Error("Failed to get uploaded file", "object", objectName, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+	defer object.Close()
+	info := object.Info()
+	if info.Size > maxUploadBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File size exceeds the upload limit", "size": info.Size, "max_bytes": maxUploadBytes})
+		return
+	}
+
+	// A single pass validates the whole file, counts its rows for progress
+	// reporting and computes the checksums. Zip archives are read through
+	// ReadAt, so the rest of the stream is drained to finish the checksums.
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	src := hashedSource{Reader: io.TeeReader(object, io.MultiWriter(md5Hash, sha256Hash)), ReaderAt: object}
+	report, format, ok := validateInput(c, src, info.Size)
+	if !ok {
+		return
+	}
+	if req.MD5 != "" || req.SHA256 != "" {
+		if _, err := io.Copy(io.Discard, src.Reader); err != nil {
+			logger.Error("Failed to read uploaded file", "job_id", job.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+			return
+		}
+	}
+	if req.MD5 != "" && !strings.EqualFold(req.MD5, hex.EncodeToString(md5Hash.Sum(nil))) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "MD5 checksum does not match the uploaded file"})
+		return
+	}
+	if req.SHA256 != "" && !strings.EqualFold(req.SHA256, hex.EncodeToString(sha256Hash.Sum(nil))) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "SHA-256 checksum does not match the uploaded file"})
+		return
+	}
+
+	// Only one concurrent start request may enqueue the job. The message is
+	// stored with the status change and published by the outbox relay.
+	err = jobRepo.InTx(c.Request.Context(), func(tx *jobs.Tx) error {
+		if _, err := tx.Transition(c.Request.Context(), job.ID, jobs.Pending, jobs.Change{Fields: map[string]any{"rows_total": report.RowCount, "has_header": report.HasHeader}}); err != nil {
+			return err
+		}
+		return outbox.EnqueueJob(c.Request.Context(), tx, jobMessage(c, jobs.NewJob{
+			ID:          job.ID,
+			InputPath:   objectName,
+			APIKeyID:    job.APIKeyID,
+			Label:       job.Label,
+			MaxCalls:    job.MaxCalls,
+			MaxCostUSD:  job.MaxCostUSD,
+			ParentJobID: job.ParentJobID,
+		}, format), int64(report.RowCount))
+	})
+	if errors.Is(err, jobs.ErrInvalidTransition) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Job has already been started"})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to update job status to PENDING", "job_id", job.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start job"})
+		return
+	}
+	relay.Notify()
+
+	logger.Info("Started job from direct upload", "job_id", job.ID, "size", info.Size, "rows", report.RowCount)
+	respondJobAccepted(c, job.ID, report)
+}
+
+// hashedSource reads an object through a hashing tee while still allowing
+// random access for zip archives.
+type hashedSource struct {
+	io.Reader
+	io.ReaderAt
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+
+	"processador-de-enderecos/internal/jobs"
+)
+
+// JobResult is a row of the job_results table.
+type JobResult struct {
+	RowNumber        int             `db:"row_number"`
+	Input            pq.StringArray  `db:"input"`
+	Address          string          `db:"address"`
+	Status           string          `db:"status"`
+	PlaceID          sql.NullString  `db:"place_id"`
+	Name             sql.NullString  `db:"name"`
+	FormattedAddress sql.NullString  `db:"formatted_address"`
+	Phone            sql.NullString  `db:"phone"`
+	Website          sql.NullString  `db:"website"`
+	Lat              sql.NullFloat64 `db:"lat"`
+	Lng              sql.NullFloat64 `db:"lng"`
+	Score            sql.NullFloat64 `db:"score"`
+	Error            sql.NullString  `db:"error"`
+}
+
+const jobResultColumns = "row_number, input, address, status, place_id, name, formatted_address, phone, website, lat, lng, score, error"
+
+func (r JobResult) response() gin.H {
+	response := gin.H{
+		"row":     r.RowNumber,
+		"input":   r.Input,
+		"address": r.Address,
+		"status":  r.Status,
+	}
+	optional := map[string]sql.NullString{
+		"place_id":          r.PlaceID,
+		"name":              r.Name,
+		"formatted_address": r.FormattedAddress,
+		"phone":             r.Phone,
+		"website":           r.Website,
+		"error":             r.Error,
+	}
+	for key, value := range optional {
+		if value.Valid {
+			response[key] = value.String
+		}
+	}
+	if r.Lat.Valid && r.Lng.Valid {
+		response["location"] = gin.H{"lat": r.Lat.Float64, "lng": r.Lng.Float64}
+	}
+	if r.Score.Valid {
+		response["score"] = r.Score.Float64
+	}
+	return response
+}
+
+// likeEscaper escapes the LIKE wildcards and the escape character itself.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// handleListJobResults pages through the stored result rows of a job in input
+// order, optionally filtered by status or by a search term.
+func handleListJobResults(c *gin.Context) {
+	jobID := c.Param("job_id")
+
+	var job Job
+	if err := getJob(c, &job, jobID); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+			return
+		}
+		logger.Error("Failed to get job from database", "job_id", jobID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get job"})
+		return
+	}
+
+	if job.Status == jobs.Expired {
+		c.JSON(http.StatusGone, gin.H{"error": "Job data expired after the retention period"})
+		return
+	}
+
+	conditions := []string{"job_id = $1"}
+	args := []interface{}{jobID}
+	addArg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if v := c.Query("status"); v != "" {
+		conditions = append(conditions, "status = ANY("+addArg(pq.Array(strings.Split(strings.ToUpper(v), ",")))+")")
+	}
+	if v := strings.TrimSpace(c.Query("q")); v != "" {
+		// The term is matched literally: wildcards typed by the user are
+		// escaped.
+		pattern := addArg("%" + likeEscaper.Replace(v) + "%")
+		conditions = append(conditions, "(address ILIKE "+pattern+" ESCAPE '\\' OR name ILIKE "+pattern+" ESCAPE '\\')")
+	}
+	if v := c.Query("after_row"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "after_row must be a non-negative integer"})
+			return
+		}
+		conditions = append(conditions, "row_number > "+addArg(n))
+	}
+
+	limit := defaultListLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxListLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxListLimit)})
+			return
+		}
+		limit = n
+	}
+
+	query := "SELECT " + jobResultColumns + " FROM job_results WHERE " + strings.Join(conditions, " AND ") +
+		" ORDER BY row_number LIMIT " + addArg(limit+1)
+
+	var rows []JobResult
+	if err := db.SelectContext(c.Request.Context(), &rows, query, args...); err != nil {
+		logger.Error("Failed to list job results", "job_id", jobID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list job results"})
+		return
+	}
+
+	response := gin.H{"job_id": job.ID, "status": job.Status}
+	if len(rows) > limit {
+		rows = rows[:limit]
+		response["next_after_row"] = rows[limit-1].RowNumber
+	}
+	items := make([]gin.H, 0, len(rows))
+	for _, row := range rows {
+		items = append(items, row.response())
+	}
+	response["results"] = items
+	c.JSON(http.StatusOK, response)
+}
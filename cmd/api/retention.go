@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+
+	"processador-de-enderecos/internal/jobs"
+)
+
+// retentionBatchSize is the number of jobs expired per sweeper transaction.
+const retentionBatchSize = 100
+
+// handleDeleteJob removes a job, its upload, its results and its result rows.
+func handleDeleteJob(c *gin.Context) {
+	jobID := c.Param("job_id")
+
+	var job Job
+	if err := getJob(c, &job, jobID); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+			return
+		}
+		logger.Error("Failed to get job from database", "job_id", jobID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get job"})
+		return
+	}
+	// A queued or running job would recreate its result after deletion.
+	if job.Status.Active() {
+		c.JSON(http.StatusConflict, gin.H{"error": "Job is still running", "status": job.Status})
+		return
+	}
+
+	if err := removeJobObjects(c.Request.Context(), &job); err != nil {
+		logger.Error("Failed to remove job files", "job_id", job.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete job files"})
+		return
+	}
+	// job_results rows are removed by ON DELETE CASCADE.
+	if _, err := db.ExecContext(c.Request.Context(), "DELETE FROM jobs WHERE id = $1", job.ID); err != nil {
+		logger.Error("Failed to delete job from database", "job_id", job.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete job"})
+		return
+	}
+
+	logger.Info("Deleted job", "job_id", job.ID)
+	c.Status(http.StatusNoContent)
+}
+
+// removeJobObjects deletes the upload and result files of a job. Missing
+// objects are not an error.
+func removeJobObjects(ctx context.Context, job *Job) error {
+	if err := uploadStore.Delete(ctx, jobInputPath(job)); err != nil {
+		return err
+	}
+	for _, path := range []sql.NullString{job.ResultPath, job.MergedResultPath} {
+		if !path.Valid {
+			continue
+		}
+		if err := resultStore.Delete(ctx, path.String); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runRetentionSweeper expires finished jobs older than retention every
+// interval until ctx is done.
+func runRetentionSweeper(ctx context.Context, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := expireJobs(ctx, time.Now().Add(-retention))
+		if err != nil {
+			logger.Error("Failed to expire old jobs", "error", err)
+		} else if n > 0 {
+			logger.Info("Expired old jobs", "count", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expireJobs removes the files and result rows of jobs last updated before
+// cutoff and marks them EXPIRED. Rows are locked with SKIP LOCKED so several
+// API replicas can sweep at the same time. Jobs whose files cannot be removed
+// are logged and left for the next sweep.
+func expireJobs(ctx context.Context, cutoff time.Time) (int, error) {
+	total := 0
+	failed := []string{}
+	for {
+		n, selected, err := expireBatch(ctx, cutoff, &failed)
+		total += n
+		if err != nil || selected < retentionBatchSize {
+			return total, err
+		}
+	}
+}
+
+// expirableStatuses are the statuses of jobs the sweeper may expire.
+var expirableStatuses = []jobs.Status{jobs.Completed, jobs.BudgetExceeded, jobs.Failed, jobs.Cancelled, jobs.AwaitingUpload}
+
+// expireBatch expires up to retentionBatchSize jobs, other than those in
+// failed, and returns how many it expired and selected. Jobs whose files
+// cannot be removed are added to failed, so the following batches move past
+// them, and the others are still expired.
+func expireBatch(ctx context.Context, cutoff time.Time, failed *[]string) (expired, selected int, err error) {
+	err = jobRepo.InTx(ctx, func(tx *jobs.Tx) error {
+		var batch []Job
+		err := tx.SelectContext(ctx, &batch, "SELECT "+jobColumns+" FROM jobs WHERE status = ANY($1) AND updated_at < $2 AND id <> ALL($3::uuid[]) ORDER BY updated_at LIMIT $4 FOR UPDATE SKIP LOCKED",
+			pq.Array(expirableStatuses), cutoff, pq.Array(*failed), retentionBatchSize)
+		if err != nil {
+			return err
+		}
+		selected = len(batch)
+
+		for i := range batch {
+			job := &batch[i]
+			if err := removeJobObjects(ctx, job); err != nil {
+				logger.Error("Failed to remove files of expired job", "job_id", job.ID, "error", err)
+				*failed = append(*failed, job.ID)
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, "DELETE FROM job_results WHERE job_id = $1", job.ID); err != nil {
+				return err
+			}
+			_, err := tx.Transition(ctx, job.ID, jobs.Expired, jobs.Change{Fields: map[string]any{"input_path": nil, "result_path": nil, "merged_result_path": nil}})
+			if err != nil {
+				return err
+			}
+			expired++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, selected, err
+	}
+	return expired, selected, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"processador-de-enderecos/internal/decompress"
+	"processador-de-enderecos/internal/jobs"
+)
+
+// retryableStatuses are the row statuses re-run when none are given.
+var retryableStatuses = []string{"NEARBY_SEARCH_FAILED", "GET_DETAILS_FAILED", "ERROR", "BUDGET_EXCEEDED"}
+
+// retryRow is a row of a finished job to re-run.
+type retryRow struct {
+	RowNumber int64          `db:"row_number"`
+	Input     pq.StringArray `db:"input"`
+}
+
+// handleRetryFailed creates a child job that re-runs the rows of a finished
+// job with the selected statuses. Retrying the BUDGET_EXCEEDED rows of a job
+// that ran out of budget also re-runs the rows it never read. When the child
+// finishes, the worker also stores the parent result with the retried rows
+// replaced.
+func handleRetryFailed(c *gin.Context) {
+	jobID := c.Param("job_id")
+
+	opts, err := parseJobOptions(c.Query)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	statuses := retryableStatuses
+	if v := c.Query("status"); v != "" {
+		statuses = strings.Split(strings.ToUpper(v), ",")
+	}
+
+	var parent Job
+	if err := getJob(c, &parent, jobID); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+			return
+		}
+		logger.Error("Failed to get job from database", "job_id", jobID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get job"})
+		return
+	}
+	switch parent.Status {
+	case jobs.Completed, jobs.BudgetExceeded, jobs.Failed:
+	default:
+		c.JSON(http.StatusConflict, gin.H{"error": "Only finished jobs can be retried", "status": parent.Status})
+		return
+	}
+	if !parent.ResultPath.Valid {
+		c.JSON(http.StatusConflict, gin.H{"error": "Job has no result to retry", "status": parent.Status})
+		return
+	}
+
+	var rows []retryRow
+	err = db.SelectContext(c.Request.Context(), &rows, "SELECT row_number, input FROM job_results WHERE job_id = $1 AND status = ANY($2) ORDER BY row_number",
+		parent.ID, pq.Array(statuses))
+	if err != nil {
+		logger.Error("Failed to list rows to retry", "job_id", parent.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list rows to retry"})
+		return
+	}
+	if parent.Status == jobs.BudgetExceeded && slices.Contains(statuses, "BUDGET_EXCEEDED") {
+		unread, err := unreadRows(c.Request.Context(), &parent)
+		if err != nil {
+			logger.Error("Failed to list unread rows", "job_id", parent.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list rows to retry"})
+			return
+		}
+		rows = append(rows, unread...)
+		sort.Slice(rows, func(i, j int) bool { return rows[i].RowNumber < rows[j].RowNumber })
+	}
+	if len(rows) == 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Job has no rows with the selected statuses", "statuses": statuses})
+		return
+	}
+
+	// The child input keeps the parent's header, or gets one if the parent
+	// had none.
+	header := uploadHeader(c.Request.Context(), &parent)
+	if header == nil {
+		for i := range rows[0].Input {
+			header = append(header, fmt.Sprintf("column_%d", i+1))
+		}
+	}
+	var buf bytes.Buffer
+	csvWriter := csv.NewWriter(&buf)
+	_ = csvWriter.Write(header)
+	retryRows := make([]int64, len(rows))
+	for i, row := range rows {
+		_ = csvWriter.Write(row.Input)
+		retryRows[i] = row.RowNumber
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		logger.Error("Failed to build retry input", "job_id", parent.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build retry input"})
+		return
+	}
+
+	if opts.dryRun {
+		estimate, err := estimateCost(c.Request.Context(), bytes.NewReader(buf.Bytes()), true)
+		if err != nil {
+			logger.Error("Failed to estimate job cost", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to estimate job cost"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"dry_run": true, "parent_job_id": parent.ID, "rows_total": len(rows), "estimate": estimate})
+		return
+	}
+
+	childID := uuid.New().String()
+	objectName := "uploads/" + childID + ".csv"
+	_, err = uploadStore.Put(c.Request.Context(), objectName, bytes.NewReader(buf.Bytes()), int64(buf.Len()), "text/csv")
+	if err != nil {
+		logger.Error("Failed to store retry input", "object", objectName, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file"})
+		return
+	}
+
+	label := opts.label
+	if !label.Valid {
+		label = parent.Label
+	}
+	// The child belongs to the parent's API key even when an admin retries it.
+	err = createJob(c, jobs.NewJob{
+		ID:          childID,
+		Status:      jobs.Pending,
+		InputPath:   objectName,
+		APIKeyID:    parent.APIKeyID,
+		Label:       label,
+		RowsTotal:   sql.NullInt64{Int64: int64(len(rows)), Valid: true},
+		MaxCalls:    opts.maxCalls,
+		MaxCostUSD:  opts.maxCostUSD,
+		ParentJobID: sql.NullString{String: parent.ID, Valid: true},
+		RetryRows:   retryRows,
+	}, decompress.Plain)
+	if err != nil {
+		logger.Error("Failed to create job in database", "job_id", childID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create job"})
+		return
+	}
+
+	logger.Info("Created retry job", "job_id", childID, "parent_job_id", parent.ID, "rows", len(rows))
+	c.JSON(http.StatusAccepted, gin.H{
+		"job_id":        childID,
+		"parent_job_id": parent.ID,
+		"status":        jobs.Pending,
+		"rows_total":    len(rows),
+		"statuses":      statuses,
+	})
+}
+
+// unreadRows returns the rows of a job's input that were never processed,
+// e.g. because the job ran out of budget first, i.e. those missing from
+// job_results. The rows of a retry job are numbered as in its parent.
+func unreadRows(ctx context.Context, job *Job) ([]retryRow, error) {
+	var processed []int64
+	if err := db.SelectContext(ctx, &processed, "SELECT row_number FROM job_results WHERE job_id = $1 ORDER BY row_number", job.ID); err != nil {
+		return nil, err
+	}
+	if job.RowsTotal.Valid && int64(len(processed)) >= job.RowsTotal.Int64 {
+		return nil, nil
+	}
+	var parentRows pq.Int64Array
+	if err := db.GetContext(ctx, &parentRows, "SELECT retry_rows FROM jobs WHERE id = $1", job.ID); err != nil {
+		return nil, err
+	}
+
+	object, err := uploadStore.Get(ctx, jobInputPath(job))
+	if err != nil {
+		return nil, fmt.Errorf("opening input: %w", err)
+	}
+	defer object.Close()
+	rc, _, err := decompress.NewReader(object, object.Info().Size, maxDecompressedBytes)
+	if err != nil {
+		return nil, fmt.Errorf("opening input: %w", err)
+	}
+	defer rc.Close()
+
+	csvReader := csv.NewReader(rc)
+	csvReader.FieldsPerRecord = -1
+	if job.HasHeader {
+		if _, err := csvReader.Read(); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("reading input: %w", err)
+		}
+	}
+	var rows []retryRow
+	for line := 1; ; line++ {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading input: %w", err)
+		}
+		row := int64(line)
+		if line <= len(parentRows) {
+			row = parentRows[line-1]
+		}
+		if _, found := slices.BinarySearch(processed, row); !found {
+			rows = append(rows, retryRow{RowNumber: row, Input: record})
+		}
+	}
+}
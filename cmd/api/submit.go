@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"processador-de-enderecos/internal/csvcheck"
+	"processador-de-enderecos/internal/decompress"
+)
+
+// maxSubmitBytes caps the body of a JSON job submission, like the CSV upload.
+const maxSubmitBytes = 10 * 1024 * 1024
+
+// addressRecord is one entry of a JSON or NDJSON job submission.
+type addressRecord struct {
+	ID      recordID `json:"id"`
+	Address string   `json:"address"`
+}
+
+// recordID accepts both string and numeric ids.
+type recordID string
+
+func (id *recordID) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*id = recordID(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return errors.New("id must be a string or a number")
+	}
+	*id = recordID(n.String())
+	return nil
+}
+
+// submitColumns is the header of the CSV generated from JSON submissions.
+// The address comes first because the worker reads it from the first column.
+var submitColumns = []string{"address", "id"}
+
+// handleCreateJob creates a job from a JSON array or an NDJSON stream of
+// address records. The records are stored as CSV so the worker processes
+// them exactly like an uploaded file.
+func handleCreateJob(c *gin.Context) {
+	opts, err := parseJobOptions(c.Query)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxSubmitBytes)
+	var buf bytes.Buffer
+	count, badLines, err := convertRecords(body, &buf)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body exceeds 10MB"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON: " + err.Error()})
+		return
+	}
+	if count == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one address record is required"})
+		return
+	}
+	if len(badLines) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": "Invalid address records",
+			"validation": gin.H{
+				"row_count":      count,
+				"bad_lines":      badLines,
+				"bad_line_count": len(badLines),
+			},
+		})
+		return
+	}
+
+	report, err := csvcheck.Check(bytes.NewReader(buf.Bytes()), csvcheck.Options{})
+	if err != nil {
+		logger.Error("Generated CSV failed validation", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to convert records"})
+		return
+	}
+
+	submitJob(c, opts, report, bytes.NewReader(buf.Bytes()), int64(buf.Len()), decompress.Plain)
+}
+
+// convertRecords decodes a JSON array or NDJSON stream of address records
+// from r and writes them to w as CSV. Records without an address are
+// reported by their 1-based position instead of being written.
+func convertRecords(r io.Reader, w io.Writer) (int, []csvcheck.LineError, error) {
+	br := bufio.NewReader(r)
+	first, err := firstNonSpace(br)
+	if err == io.EOF {
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	dec := json.NewDecoder(br)
+	if first == '[' {
+		if _, err := dec.Token(); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	csvWriter := csv.NewWriter(w)
+	if err := csvWriter.Write(submitColumns); err != nil {
+		return 0, nil, err
+	}
+
+	var badLines []csvcheck.LineError
+	count := 0
+	for dec.More() {
+		var rec addressRecord
+		if err := dec.Decode(&rec); err != nil {
+			return count, badLines, fmt.Errorf("record %d: %w", count+1, err)
+		}
+		count++
+		address := strings.TrimSpace(rec.Address)
+		if address == "" {
+			badLines = append(badLines, csvcheck.LineError{Line: count, Error: "address is empty"})
+			continue
+		}
+		if err := csvWriter.Write([]string{address, string(rec.ID)}); err != nil {
+			return count, badLines, err
+		}
+	}
+	if first == '[' {
+		if _, err := dec.Token(); err != nil {
+			return count, badLines, err
+		}
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		if err == nil {
+			err = errors.New("unexpected data after the address records")
+		}
+		return count, badLines, err
+	}
+
+	csvWriter.Flush()
+	return count, badLines, csvWriter.Error()
+}
+
+// firstNonSpace skips leading whitespace and returns the next byte without
+// consuming it.
+func firstNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			return b, br.UnreadByte()
+		}
+	}
+}
@@ -2,19 +2,31 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"expvar"
+	"fmt"
 	"log"
 	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
-	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/streadway/amqp"
-	"golang.org/x/time/rate"
 
+	"processador-de-enderecos/internal/cache"
+	"processador-de-enderecos/internal/jobs"
+	"processador-de-enderecos/internal/messages"
+	"processador-de-enderecos/internal/migrate"
+	"processador-de-enderecos/internal/outbox"
 	"processador-de-enderecos/internal/processor"
+	"processador-de-enderecos/internal/rabbitmq"
+	"processador-de-enderecos/internal/ratelimit"
+	"processador-de-enderecos/internal/scheduler"
+	"processador-de-enderecos/internal/storage"
 	"processador-de-enderecos/pkg/googlemaps"
 )
 
@@ -25,10 +37,40 @@ func main() {
 	// Config
 	dbDSN := os.Getenv("DB_DSN")
 	rabbitmqURL := os.Getenv("RABBITMQ_URL")
-	minioEndpoint := os.Getenv("MINIO_ENDPOINT")
-	minioAccessKeyID := os.Getenv("MINIO_ACCESS_KEY_ID")
-	minioSecretAccessKey := os.Getenv("MINIO_SECRET_ACCESS_KEY")
 	googleMapsAPIKey := os.Getenv("GOOGLE_MAPS_API_KEY")
+	placeCacheTTL, err := time.ParseDuration(os.Getenv("PLACE_CACHE_TTL"))
+	if err != nil {
+		placeCacheTTL = 30 * 24 * time.Hour
+	}
+	// Monthly Google usage caps per API key; empty means unlimited
+	var monthlyLimits processor.MonthlyLimits
+	monthlyLimits.MaxCalls, _ = strconv.ParseInt(os.Getenv("MONTHLY_MAX_CALLS"), 10, 64)
+	monthlyLimits.MaxCostUSD, _ = strconv.ParseFloat(os.Getenv("MONTHLY_MAX_COST_USD"), 64)
+	// Decompressed size limit for gzip, zstd and zip inputs
+	maxInputBytes, err := strconv.ParseInt(os.Getenv("MAX_DECOMPRESSED_BYTES"), 10, 64)
+	if err != nil || maxInputBytes <= 0 {
+		maxInputBytes = 4 << 30 // 4GB
+	}
+	// Jobs processed at once, and messages of the priority queue held by
+	// the worker to choose the next job from, shared fairly between tenants
+	concurrency, err := strconv.Atoi(os.Getenv("WORKER_CONCURRENCY"))
+	if err != nil || concurrency <= 0 {
+		concurrency = 4
+	}
+	prefetch, err := strconv.Atoi(os.Getenv("WORKER_PREFETCH"))
+	if err != nil || prefetch < concurrency {
+		prefetch = 4 * concurrency
+	}
+	// Jobs with more rows are split into chunks of this many rows, processed
+	// by any worker; 0 disables splitting
+	chunkRows, err := strconv.Atoi(os.Getenv("CHUNK_ROWS"))
+	if err != nil || chunkRows < 0 {
+		chunkRows = 10000
+	}
+	relayInterval, err := time.ParseDuration(os.Getenv("OUTBOX_POLL_INTERVAL"))
+	if err != nil || relayInterval <= 0 {
+		relayInterval = time.Second
+	}
 
 	// PostgreSQL
 	db, err := sqlx.Connect("postgres", dbDSN)
@@ -37,86 +79,159 @@ func main() {
 		log.Fatalf("Failed to connect to PostgreSQL: %v", err)
 	}
 
-	// RabbitMQ
-	conn, err := amqp.Dial(rabbitmqURL)
+	// Schema migrations: "migrate [up|down [steps]|version]" runs them and
+	// exits; otherwise pending ones are applied at startup.
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate.Run(context.Background(), db.DB, os.Args[2:], logger); err != nil {
+			logger.Error("Failed to run migrations", "error", err)
+			log.Fatalf("Failed to run migrations: %v", err)
+		}
+		return
+	}
+	if autoMigrate, err := strconv.ParseBool(os.Getenv("AUTO_MIGRATE")); err != nil || autoMigrate {
+		applied, err := migrate.Up(context.Background(), db.DB)
+		if err != nil {
+			logger.Error("Failed to apply migrations", "error", err)
+			log.Fatalf("Failed to apply migrations: %v", err)
+		}
+		for _, m := range applied {
+			logger.Info("Applied migration", "version", m.Version, "name", m.Name)
+		}
+	}
+
+	// RabbitMQ. The client reconnects on its own when the connection drops
+	// and registers the consumer again.
+	rabbit, err := rabbitmq.Dial(rabbitmqURL, rabbitmq.DeclareTopology, logger)
 	if err != nil {
 		logger.Error("Failed to connect to RabbitMQ", "error", err)
 		log.Fatalf("Failed to connect to RabbitMQ: %v", err)
 	}
-	defer conn.Close()
+	defer rabbit.Close()
 
-	ch, err := conn.Channel()
+	// Object storage (MinIO/S3 or a local directory)
+	uploadStore, resultStore, err := storage.Open(storage.ConfigFromEnv())
 	if err != nil {
-		logger.Error("Failed to open a RabbitMQ channel", "error", err)
-		log.Fatalf("Failed to open a channel: %v", err)
-	}
-	defer ch.Close()
-
-	q, err := ch.QueueDeclare(
-		"jobs.queue", // name
-		true,         // durable
-		false,        // delete when unused
-		false,        // exclusive
-		false,        // no-wait
-		nil,          // arguments
-	)
-	if err != nil {
-		logger.Error("Failed to declare a RabbitMQ queue", "error", err)
-		log.Fatalf("Failed to declare a queue: %v", err)
+		logger.Error("Failed to configure object storage", "error", err)
+		log.Fatalf("Failed to configure object storage: %v", err)
 	}
 
-	// MinIO
-	minioClient, err := minio.New(minioEndpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(minioAccessKeyID, minioSecretAccessKey, ""),
-		Secure: false,
-	})
-	if err != nil {
-		logger.Error("Failed to connect to MinIO", "error", err)
-		log.Fatalf("Failed to connect to MinIO: %v", err)
+	// Google Maps Client. The request rates of each endpoint are shared by
+	// all worker replicas through PostgreSQL unless RATE_LIMIT_BACKEND=local.
+	rates := googlemaps.RatesFromEnv()
+	var limiter googlemaps.Limiter
+	if os.Getenv("RATE_LIMIT_BACKEND") == "local" {
+		limiter = googlemaps.NewLocalLimiter(rates)
+	} else {
+		// While PostgreSQL is unreachable each replica allows its share
+		replicas, err := strconv.Atoi(os.Getenv("RATE_LIMIT_REPLICAS"))
+		if err != nil || replicas <= 0 {
+			replicas = 1
+		}
+		limiter = ratelimit.NewPostgres(db, rates, replicas, logger)
+	}
+	// Each worker also lowers its own rate when Google answers
+	// OVER_QUERY_LIMIT or slows down, unless MAPS_ADAPTIVE=false.
+	if adaptive, err := strconv.ParseBool(os.Getenv("MAPS_ADAPTIVE")); err != nil || adaptive {
+		adaptiveLimiter := googlemaps.NewAdaptiveLimiter(limiter, rates)
+		expvar.Publish("maps_rate_limiter", expvar.Func(func() any { return adaptiveLimiter.Stats() }))
+		limiter = adaptiveLimiter
 	}
-
-	// Google Maps Client
-	limiter := rate.NewLimiter(rate.Limit(50), 50)
 	mapsClient := googlemaps.NewClient(googleMapsAPIKey, limiter)
 
-	// Job Processor
-	jobProcessor := processor.NewJobProcessor(db, minioClient, mapsClient, logger)
-
-	// RabbitMQ Consumer
-	msgs, err := ch.Consume(
-		q.Name, // queue
-		"",     // consumer
-		false,  // auto-ack
-		false,  // exclusive
-		false,  // no-local
-		false,  // no-wait
-		nil,    // args
-	)
-	if err != nil {
-		logger.Error("Failed to register a RabbitMQ consumer", "error", err)
-		log.Fatalf("Failed to register a consumer: %v", err)
+	// Metrics, served by expvar at /debug/vars
+	if metricsAddr := os.Getenv("METRICS_ADDR"); metricsAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(metricsAddr, nil); err != nil {
+				logger.Error("Metrics server stopped", "error", err)
+			}
+		}()
 	}
 
-	var forever chan struct{}
-
-	go func() {
-		for d := range msgs {
-			var jobData map[string]string
-			if err := json.Unmarshal(d.Body, &jobData); err != nil {
-				logger.Error("Error decoding job data", "error", err)
-				d.Nack(false, false) // To dead-letter queue
-				continue
-			}
+	// Place cache, shared with the API's dry-run estimates
+	placeCache := cache.NewPlaceCache(db, placeCacheTTL)
+
+	// Job Processor. Status changes are attributed to this process in the
+	// job history.
+	hostname, _ := os.Hostname()
+	jobRepo := jobs.NewRepository(db, fmt.Sprintf("worker/%s-%d", hostname, os.Getpid()))
+	// Chunk messages go through the outbox, published by this worker's relay
+	relay := outbox.NewRelay(jobRepo, rabbit, relayInterval, logger)
+	go relay.Run(context.Background())
+	jobProcessor := processor.NewJobProcessor(db, jobRepo, uploadStore, resultStore, mapsClient, placeCache, googlemaps.PriceTableFromEnv(), monthlyLimits, maxInputBytes, chunkRows, relay, logger)
+
+	// RabbitMQ Consumers. The broker hands out the highest-priority
+	// messages first; the scheduler then takes turns between the tenants of
+	// the prefetched ones. The legacy queue is only being drained, so it
+	// holds a single message at a time, leaving the prefetch bound to the
+	// priority queue. Messages are acknowledged once their job is done.
+	// When a worker dies the broker delivers its messages again, and the
+	// worker receiving one reclaims the job once its owner has stopped
+	// sending heartbeats for jobLeaseTimeout; until then it waits, as the
+	// broker also redelivers messages of live workers. Messages that cannot
+	// be decoded, including those of an unknown schema version, are moved to
+	// the dead-letter queue.
+	sched := scheduler.NewFair(concurrency)
+	handle := func(d amqp.Delivery) {
+		msg, err := messages.DecodeJobMessage(d.Body)
+		if err != nil {
+			logger.Error("Error decoding job message", "error", err)
+			deadLetter(rabbit, d, err, logger)
+			return
+		}
 
-			jobID := jobData["job_id"]
-			csvPath := jobData["caminho_csv"]
-			logger.Info("Received a new job", "job_id", jobID, "csv_path", csvPath)
+		logger.Info("Received a new job", "job_id", msg.JobID, "input_path", msg.InputPath, "schema_version", msg.SchemaVersion,
+			"priority", d.Priority, "redelivered", d.Redelivered, "format", msg.Format, "tenant", msg.Tenant, "chunk", msg.Chunk)
 
-			go jobProcessor.ProcessJob(context.Background(), jobID, csvPath)
+		ok := sched.Submit(msg.Tenant, func() {
+			if msg.Chunk != nil {
+				jobProcessor.ProcessChunk(context.Background(), msg)
+			} else {
+				jobProcessor.ProcessJob(context.Background(), msg)
+			}
 			d.Ack(false)
+		})
+		if !ok {
+			// The worker is shutting down. The delivery stays unacknowledged,
+			// so the broker requeues it when the connection closes instead
+			// of delivering it here again.
+			return
 		}
-	}()
+	}
+	consumers := map[string]int{rabbitmq.JobQueue: prefetch, rabbitmq.LegacyJobQueue: 1}
+	for queue, queuePrefetch := range consumers {
+		if err := rabbit.Consume(queue, queuePrefetch, handle); err != nil {
+			logger.Error("Failed to register a RabbitMQ consumer", "queue", queue, "error", err)
+			log.Fatalf("Failed to register a consumer: %v", err)
+		}
+	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	logger.Info("Worker is waiting for messages. To exit press CTRL+C")
-	<-forever
+	<-ctx.Done()
+
+	// Graceful shutdown: running jobs finish and acknowledge their messages;
+	// the queued ones are dropped and, when the connection closes, requeued
+	// by the broker for the other workers. A second signal exits at once.
+	stop()
+	logger.Info("Shutting down, waiting for running jobs")
+	discarded := sched.Close()
+	logger.Info("Running jobs finished, worker stopped", "requeued", discarded)
+}
+
+// deadLetter publishes an undecodable delivery to the dead-letter queue with
+// the decoding error, then acknowledges it. If the publish fails the delivery
+// is rejected instead, so it is not redelivered forever.
+func deadLetter(rabbit *rabbitmq.Client, d amqp.Delivery, decodeErr error, logger *slog.Logger) {
+	err := rabbit.Publish(context.Background(), rabbitmq.DeadLetterQueue, amqp.Publishing{
+		Headers:      amqp.Table{"x-error": decodeErr.Error(), "x-original-queue": d.RoutingKey},
+		ContentType:  d.ContentType,
+		DeliveryMode: amqp.Persistent,
+		Body:         d.Body,
+	})
+	if err != nil {
+		logger.Error("Failed to dead-letter job message", "error", err)
+		d.Nack(false, false)
+		return
+	}
+	d.Ack(false)
 }
@@ -0,0 +1,16 @@
+package address
+
+import (
+	"strings"
+)
+
+// Normalize trims an address and collapses repeated whitespace.
+func Normalize(address string) string {
+	return strings.Join(strings.Fields(address), " ")
+}
+
+// Key returns the form of an address used to detect duplicates and to look
+// it up in the place cache.
+func Key(address string) string {
+	return strings.ToLower(strings.Trim(Normalize(address), " ,.;"))
+}
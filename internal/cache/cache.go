@@ -0,0 +1,55 @@
+package cache
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// PlaceCache stores the resolved result of an address in PostgreSQL so that
+// addresses already seen by any job are not sent to Google again.
+type PlaceCache struct {
+	db  *sqlx.DB
+	ttl time.Duration
+}
+
+// NewPlaceCache creates a new PlaceCache whose entries expire after ttl.
+func NewPlaceCache(db *sqlx.DB, ttl time.Duration) *PlaceCache {
+	return &PlaceCache{
+		db:  db,
+		ttl: ttl,
+	}
+}
+
+// Get returns the cached result for an address key, if present and fresh.
+func (c *PlaceCache) Get(ctx context.Context, key string) (json.RawMessage, bool, error) {
+	var result []byte
+	err := c.db.GetContext(ctx, &result, "SELECT result FROM place_cache WHERE address_key = $1 AND expires_at > NOW()", key)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return result, true, nil
+}
+
+// Set stores or replaces the result for an address key.
+func (c *PlaceCache) Set(ctx context.Context, key string, result json.RawMessage) error {
+	now := time.Now()
+	_, err := c.db.ExecContext(ctx, `INSERT INTO place_cache (address_key, result, created_at, expires_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (address_key) DO UPDATE SET result = EXCLUDED.result, created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at`,
+		key, []byte(result), now, now.Add(c.ttl))
+	return err
+}
+
+// CountHits returns how many of the given address keys have a fresh entry.
+func (c *PlaceCache) CountHits(ctx context.Context, keys []string) (int, error) {
+	var hits int
+	err := c.db.GetContext(ctx, &hits, "SELECT COUNT(*) FROM place_cache WHERE address_key = ANY($1) AND expires_at > NOW()", pq.Array(keys))
+	return hits, err
+}
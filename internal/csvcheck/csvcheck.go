@@ -0,0 +1,190 @@
+package csvcheck
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+var (
+	// ErrEmpty is returned when the file has no rows at all.
+	ErrEmpty = errors.New("file is empty")
+	// ErrNotText is returned when the sniffed content is not plain text.
+	ErrNotText = errors.New("file content is not text")
+	// ErrNoData is returned when the file only contains a header row.
+	ErrNoData = errors.New("file has no address rows")
+	// ErrMalformed is returned when one or more lines could not be parsed.
+	ErrMalformed = errors.New("file contains malformed lines")
+)
+
+// sniffLen is the number of bytes http.DetectContentType looks at.
+const sniffLen = 512
+
+// headerNames are column names that identify the first row as a header.
+var headerNames = map[string]bool{
+	"address":    true,
+	"endereco":   true,
+	"endereço":   true,
+	"logradouro": true,
+	"id":         true,
+	"name":       true,
+	"nome":       true,
+}
+
+// Options controls how a file is reported. The whole file is always parsed,
+// as the row count becomes the job's total.
+type Options struct {
+	// MaxBadLines caps the number of bad lines listed in the report.
+	MaxBadLines int
+}
+
+// LineError describes a line that could not be used as an address row.
+type LineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// Report is the schema detected for an uploaded CSV file.
+type Report struct {
+	ContentType  string      `json:"content_type"`
+	HasHeader    bool        `json:"has_header"`
+	Columns      []string    `json:"columns,omitempty"`
+	ColumnCount  int         `json:"column_count"`
+	RowCount     int         `json:"row_count"`
+	Warnings     []string    `json:"warnings,omitempty"`
+	BadLines     []LineError `json:"bad_lines,omitempty"`
+	BadLineCount int         `json:"bad_line_count,omitempty"`
+}
+
+// Check sniffs and parses a CSV stream and reports its detected schema.
+// The report is returned together with the error so callers can show the
+// offending lines to the user.
+func Check(r io.Reader, opts Options) (*Report, error) {
+	if opts.MaxBadLines <= 0 {
+		opts.MaxBadLines = 20
+	}
+
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+
+	report := &Report{ContentType: http.DetectContentType(head)}
+	if len(bytes.TrimSpace(head)) == 0 {
+		return report, ErrEmpty
+	}
+	if !strings.HasPrefix(report.ContentType, "text/") || bytes.IndexByte(head, 0) >= 0 {
+		return report, ErrNotText
+	}
+
+	csvReader := csv.NewReader(br)
+	csvReader.FieldsPerRecord = -1
+	csvReader.ReuseRecord = true
+
+	var first []string
+	var firstLine int
+	decided := false
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				report.addBadLine(opts, parseErr.StartLine, parseErr.Err.Error())
+				continue
+			}
+			return report, err
+		}
+
+		line, _ := csvReader.FieldPos(0)
+		if first == nil {
+			first = append([]string(nil), record...)
+			firstLine = line
+			report.ColumnCount = len(first)
+			continue
+		}
+		if !decided {
+			decided = true
+			report.HasHeader = looksLikeHeader(first, record)
+			if report.HasHeader {
+				report.Columns = first
+			} else {
+				report.RowCount++
+				report.checkRow(opts, firstLine, first)
+			}
+		}
+
+		report.RowCount++
+		report.checkRow(opts, line, record)
+	}
+
+	if first == nil {
+		if report.BadLineCount > 0 {
+			return report, ErrMalformed
+		}
+		return report, ErrEmpty
+	}
+	if !decided {
+		// A single row is either a header without data or an address.
+		report.HasHeader = looksLikeHeader(first, nil)
+		if report.HasHeader {
+			report.Columns = first
+			return report, ErrNoData
+		}
+		report.RowCount++
+		report.checkRow(opts, firstLine, first)
+	}
+	if !report.HasHeader {
+		report.Warnings = append(report.Warnings, "no header row detected; the first line is processed as an address")
+	}
+	if report.BadLineCount > 0 {
+		return report, ErrMalformed
+	}
+	return report, nil
+}
+
+func (r *Report) checkRow(opts Options, line int, record []string) {
+	if len(record) != r.ColumnCount {
+		r.addBadLine(opts, line, fmt.Sprintf("expected %d fields, got %d", r.ColumnCount, len(record)))
+		return
+	}
+	if strings.TrimSpace(record[0]) == "" {
+		r.addBadLine(opts, line, "address column is empty")
+	}
+}
+
+func (r *Report) addBadLine(opts Options, line int, msg string) {
+	r.BadLineCount++
+	if len(r.BadLines) < opts.MaxBadLines {
+		r.BadLines = append(r.BadLines, LineError{Line: line, Error: msg})
+	}
+}
+
+// looksLikeHeader guesses whether the first row is a header by looking for
+// well-known column names, or for a first row without digits followed by a
+// row whose address contains a street number.
+func looksLikeHeader(first, second []string) bool {
+	for _, field := range first {
+		if headerNames[strings.ToLower(strings.TrimSpace(field))] {
+			return true
+		}
+	}
+	if second == nil || len(first) == 0 || len(second) == 0 {
+		return false
+	}
+	for _, field := range first {
+		if strings.IndexFunc(field, unicode.IsDigit) >= 0 {
+			return false
+		}
+	}
+	return strings.IndexFunc(strings.Join(second, " "), unicode.IsDigit) >= 0
+}
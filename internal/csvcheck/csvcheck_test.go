@@ -0,0 +1,112 @@
+package csvcheck
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLooksLikeHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		first  []string
+		second []string
+		want   bool
+	}{
+		{"known column name", []string{"Endereço"}, []string{"Rua A, 1"}, true},
+		{"known name padded", []string{" id ", "address"}, nil, true},
+		{"known name without data", []string{"nome"}, nil, true},
+		{"text over an address with a number", []string{"local"}, []string{"Rua A, 1"}, true},
+		{"first row has digits", []string{"Rua A, 1"}, []string{"Rua B, 2"}, false},
+		{"no digits in either row", []string{"local"}, []string{"Praça da Sé"}, false},
+		{"single unknown row", []string{"local"}, nil, false},
+		{"empty first row", []string{}, []string{"Rua A, 1"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := looksLikeHeader(tt.first, tt.second); got != tt.want {
+				t.Fatalf("looksLikeHeader(%q, %q) = %v, want %v", tt.first, tt.second, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		opts  Options
+		want  Report
+		err   error
+	}{
+		{
+			name:  "unquoted comma in an address",
+			input: "endereco,nome\nRua A, 1,Loja A\n\"Rua B, 2\",Loja B\n",
+			want: Report{HasHeader: true, Columns: []string{"endereco", "nome"}, ColumnCount: 2, RowCount: 2,
+				BadLines: []LineError{{Line: 2, Error: "expected 2 fields, got 3"}}, BadLineCount: 1},
+			err: ErrMalformed,
+		},
+		{
+			name:  "quoted rows",
+			input: "endereco,nome\n\"Rua A, 1\",Loja A\n\"Rua B, 2\",Loja B\n",
+			want:  Report{HasHeader: true, Columns: []string{"endereco", "nome"}, ColumnCount: 2, RowCount: 2},
+		},
+		{
+			name:  "no header",
+			input: "Rua A 1\nRua B 2\n",
+			want:  Report{ColumnCount: 1, RowCount: 2, Warnings: []string{"no header row detected; the first line is processed as an address"}},
+		},
+		{
+			name:  "single address",
+			input: "Rua A 1\n",
+			want:  Report{ColumnCount: 1, RowCount: 1, Warnings: []string{"no header row detected; the first line is processed as an address"}},
+		},
+		{
+			name:  "header only",
+			input: "endereco\n",
+			want:  Report{HasHeader: true, Columns: []string{"endereco"}, ColumnCount: 1},
+			err:   ErrNoData,
+		},
+		{
+			name:  "empty",
+			input: " \n\n",
+			want:  Report{},
+			err:   ErrEmpty,
+		},
+		{
+			name:  "binary",
+			input: "\x00\x01\x02endereco\n",
+			want:  Report{},
+			err:   ErrNotText,
+		},
+		{
+			name:  "bad lines are capped",
+			input: "endereco,nome\nRua A 1,Loja A\n,Loja B\nRua C 3\nRua D 4,Loja D\n",
+			opts:  Options{MaxBadLines: 1},
+			want: Report{HasHeader: true, Columns: []string{"endereco", "nome"}, ColumnCount: 2, RowCount: 4,
+				BadLines: []LineError{{Line: 3, Error: "address column is empty"}}, BadLineCount: 2},
+			err: ErrMalformed,
+		},
+		{
+			name:  "parse error",
+			input: "endereco\nRua A 1\n\"Rua B\" 2\nRua C 3\n",
+			want: Report{HasHeader: true, Columns: []string{"endereco"}, ColumnCount: 1, RowCount: 2,
+				BadLines: []LineError{{Line: 3, Error: `extraneous or missing " in quoted-field`}}, BadLineCount: 1},
+			err: ErrMalformed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := Check(strings.NewReader(tt.input), tt.opts)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Check() error = %v, want %v", err, tt.err)
+			}
+			got := *report
+			got.ContentType = ""
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Check() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package decompress
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	// ErrTooLarge is returned when the decompressed content exceeds the limit.
+	ErrTooLarge = errors.New("decompressed size exceeds the limit")
+	// ErrEmptyArchive is returned for zip archives without a file.
+	ErrEmptyArchive = errors.New("zip archive has no file")
+	// ErrMultipleFiles is returned for zip archives with more than one file.
+	ErrMultipleFiles = errors.New("zip archive must contain a single file")
+)
+
+// Format is the compression format of an input file.
+type Format string
+
+const (
+	Plain Format = "plain"
+	Gzip  Format = "gzip"
+	Zstd  Format = "zstd"
+	Zip   Format = "zip"
+)
+
+// Extension is the file name suffix used to store an input in this format.
+func (f Format) Extension() string {
+	switch f {
+	case Gzip:
+		return ".csv.gz"
+	case Zstd:
+		return ".csv.zst"
+	case Zip:
+		return ".zip"
+	default:
+		return ".csv"
+	}
+}
+
+// ContentType is the MIME type of an input in this format.
+func (f Format) ContentType() string {
+	switch f {
+	case Gzip:
+		return "application/gzip"
+	case Zstd:
+		return "application/zstd"
+	case Zip:
+		return "application/zip"
+	default:
+		return "text/csv"
+	}
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	zipMagic  = []byte("PK\x03\x04")
+)
+
+// Detect identifies the compression format from the first bytes of a file.
+func Detect(head []byte) Format {
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return Gzip
+	case bytes.HasPrefix(head, zstdMagic):
+		return Zstd
+	case bytes.HasPrefix(head, zipMagic):
+		return Zip
+	default:
+		return Plain
+	}
+}
+
+// Source is a compressed or plain input. Gzip and zstd are streamed from
+// Read; zip needs random access through ReadAt.
+type Source interface {
+	io.Reader
+	io.ReaderAt
+}
+
+// NewReader detects the compression of src by its magic bytes and returns a
+// reader of the decompressed content, which fails with ErrTooLarge after
+// limit bytes. A limit of zero disables the check. size is the length of src
+// and is only used for zip archives.
+func NewReader(src Source, size, limit int64) (io.ReadCloser, Format, error) {
+	br := bufio.NewReader(src)
+	head, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, Plain, err
+	}
+
+	format := Detect(head)
+	var r io.Reader
+	var closer func() error
+	switch format {
+	case Gzip:
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, format, err
+		}
+		r, closer = zr, zr.Close
+	case Zstd:
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, format, err
+		}
+		r, closer = zr, func() error { zr.Close(); return nil }
+	case Zip:
+		rc, err := openZip(src, size, limit)
+		if err != nil {
+			return nil, format, err
+		}
+		r, closer = rc, rc.Close
+	default:
+		r, closer = br, func() error { return nil }
+	}
+
+	if limit > 0 {
+		r = &limitedReader{r: r, remaining: limit}
+	}
+	return readCloser{Reader: r, close: closer}, format, nil
+}
+
+// zipChunkSize is the size of the ranges read from a zip archive.
+const zipChunkSize = 1 << 20
+
+// openZip opens the single file of a zip archive. Directories and macOS
+// metadata entries are ignored.
+func openZip(src io.ReaderAt, size, limit int64) (io.ReadCloser, error) {
+	zr, err := zip.NewReader(&chunkedReaderAt{r: src, size: size}, size)
+	if err != nil {
+		return nil, fmt.Errorf("invalid zip archive: %w", err)
+	}
+
+	var file *zip.File
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || strings.HasPrefix(f.Name, "__MACOSX/") || strings.HasPrefix(path.Base(f.Name), "._") {
+			continue
+		}
+		if file != nil {
+			return nil, ErrMultipleFiles
+		}
+		file = f
+	}
+	if file == nil {
+		return nil, ErrEmptyArchive
+	}
+	// The declared size can lie, so the stream is limited as well.
+	if limit > 0 && file.UncompressedSize64 > uint64(limit) {
+		return nil, ErrTooLarge
+	}
+	return file.Open()
+}
+
+// chunkedReaderAt serves the small sequential reads of archive/zip from a
+// cached chunk, so ranged sources such as MinIO objects get one request per
+// chunk instead of one per read.
+type chunkedReaderAt struct {
+	r      io.ReaderAt
+	size   int64
+	buf    []byte
+	offset int64
+}
+
+func (c *chunkedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) >= zipChunkSize {
+		return c.r.ReadAt(p, off)
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= c.size {
+			return n, io.EOF
+		}
+		if c.buf == nil || pos < c.offset || pos >= c.offset+int64(len(c.buf)) {
+			if err := c.fill(pos); err != nil {
+				return n, err
+			}
+		}
+		n += copy(p[n:], c.buf[pos-c.offset:])
+	}
+	return n, nil
+}
+
+func (c *chunkedReaderAt) fill(off int64) error {
+	length := int64(zipChunkSize)
+	if off+length > c.size {
+		length = c.size - off
+	}
+	buf := c.buf
+	if int64(cap(buf)) < length {
+		buf = make([]byte, zipChunkSize)
+	}
+	buf = buf[:length]
+	n, err := c.r.ReadAt(buf, off)
+	if n < len(buf) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		c.buf = nil
+		return err
+	}
+	c.buf, c.offset = buf, off
+	return nil
+}
+
+// limitedReader fails with ErrTooLarge once more than remaining bytes are read.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		var b [1]byte
+		n, err := l.r.Read(b[:])
+		if n > 0 {
+			return 0, ErrTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error {
+	return r.close()
+}
@@ -0,0 +1,170 @@
+package decompress
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func gzipData(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zstdData(t *testing.T, data []byte) []byte {
+	t.Helper()
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	return enc.EncodeAll(data, nil)
+}
+
+// zipData builds an archive with the given entries, in order. Names ending
+// in "/" are directories.
+func zipData(t *testing.T, entries map[string][]byte, order ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range order {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(entries[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// readAll opens src with NewReader and reads it to the end.
+func readAll(src []byte, limit int64) ([]byte, Format, error) {
+	rc, format, err := NewReader(bytes.NewReader(src), int64(len(src)), limit)
+	if err != nil {
+		return nil, format, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	return data, format, err
+}
+
+func TestNewReader(t *testing.T) {
+	csv := []byte("endereco\nRua A, 1\nRua B, 2\n")
+	tests := []struct {
+		name   string
+		src    []byte
+		format Format
+	}{
+		{"plain", csv, Plain},
+		{"gzip", gzipData(t, csv), Gzip},
+		{"zstd", zstdData(t, csv), Zstd},
+		{"zip", zipData(t, map[string][]byte{"a.csv": csv}, "a.csv"), Zip},
+		{
+			name:   "zip ignores directories and macOS metadata",
+			src:    zipData(t, map[string][]byte{"dir/": nil, "__MACOSX/._a.csv": []byte("x"), "dir/._b.csv": []byte("x"), "dir/a.csv": csv}, "dir/", "__MACOSX/._a.csv", "dir/._b.csv", "dir/a.csv"),
+			format: Zip,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, format, err := readAll(tt.src, 1<<20)
+			if err != nil {
+				t.Fatalf("reading: %v", err)
+			}
+			if format != tt.format {
+				t.Errorf("format = %s, want %s", format, tt.format)
+			}
+			if !bytes.Equal(data, csv) {
+				t.Errorf("data = %q, want %q", data, csv)
+			}
+		})
+	}
+}
+
+func TestNewReaderSizeLimit(t *testing.T) {
+	// A megabyte of zeros compresses to about a kilobyte: a small upload
+	// must not expand past the limit, whatever the compression ratio.
+	bomb := make([]byte, 1<<20)
+	exact := bytes.Repeat([]byte("a"), 1000)
+	tests := []struct {
+		name  string
+		src   []byte
+		limit int64
+		err   error
+	}{
+		{"plain over limit", exact, 999, ErrTooLarge},
+		{"plain at limit", exact, 1000, nil},
+		{"gzip at limit", gzipData(t, exact), 1000, nil},
+		{"gzip one byte over", gzipData(t, exact), 999, ErrTooLarge},
+		{"gzip bomb", gzipData(t, bomb), 64 << 10, ErrTooLarge},
+		{"zstd bomb", zstdData(t, bomb), 64 << 10, ErrTooLarge},
+		{"zip bomb", zipData(t, map[string][]byte{"a.csv": bomb}, "a.csv"), 64 << 10, ErrTooLarge},
+		{"zip at limit", zipData(t, map[string][]byte{"a.csv": exact}, "a.csv"), 1000, nil},
+		{"no limit", gzipData(t, bomb), 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _, err := readAll(tt.src, tt.limit)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error = %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && tt.limit > 0 && int64(len(data)) > tt.limit {
+				t.Fatalf("read %d bytes, over the limit of %d", len(data), tt.limit)
+			}
+		})
+	}
+}
+
+func TestNewReaderZipEntries(t *testing.T) {
+	csv := []byte("endereco\nRua A, 1\n")
+	tests := []struct {
+		name string
+		src  []byte
+		err  error
+	}{
+		{
+			name: "two files",
+			src:  zipData(t, map[string][]byte{"a.csv": csv, "b.csv": csv}, "a.csv", "b.csv"),
+			err:  ErrMultipleFiles,
+		},
+		{
+			name: "two files in directories",
+			src:  zipData(t, map[string][]byte{"x/a.csv": csv, "y/a.csv": csv}, "x/a.csv", "y/a.csv"),
+			err:  ErrMultipleFiles,
+		},
+		{
+			name: "only directories and metadata",
+			src:  zipData(t, map[string][]byte{"dir/": nil, "__MACOSX/._a.csv": []byte("x")}, "dir/", "__MACOSX/._a.csv"),
+			err:  ErrEmptyArchive,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, format, err := readAll(tt.src, 1<<20)
+			if format != Zip {
+				t.Errorf("format = %s, want %s", format, Zip)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrNotFound is returned for a job that does not exist.
+	ErrNotFound = errors.New("job not found")
+	// ErrInvalidTransition is returned when a job's current status does not
+	// allow the requested one, e.g. COMPLETED to PROCESSING.
+	ErrInvalidTransition = errors.New("invalid job status transition")
+	// ErrNotOwner is returned when a job being processed is owned by
+	// another worker, e.g. one that reclaimed it.
+	ErrNotOwner = errors.New("job owned by another worker")
+)
+
+// Repository creates jobs and changes their status. Every change is recorded
+// in job_events together with the id of the process that made it.
+type Repository struct {
+	db       *sqlx.DB
+	workerID string
+}
+
+// NewRepository returns a repository whose events are attributed to
+// workerID, e.g. "<hostname>-<pid>".
+func NewRepository(db *sqlx.DB, workerID string) *Repository {
+	return &Repository{db: db, workerID: workerID}
+}
+
+// WorkerID returns the id of the process the repository's changes are
+// attributed to.
+func (r *Repository) WorkerID() string {
+	return r.workerID
+}
+
+// Tx is a transaction in which jobs can be created and moved between
+// statuses along with other statements.
+type Tx struct {
+	*sqlx.Tx
+	workerID string
+}
+
+// InTx runs fn in a transaction, committing it if fn returns nil.
+func (r *Repository) InTx(ctx context.Context, fn func(tx *Tx) error) error {
+	sqlTx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer sqlTx.Rollback()
+
+	if err := fn(&Tx{Tx: sqlTx, workerID: r.workerID}); err != nil {
+		return err
+	}
+	return sqlTx.Commit()
+}
+
+// NewJob holds the columns of a job being created.
+type NewJob struct {
+	ID        string
+	Status    Status
+	InputPath string
+	APIKeyID  sql.NullString
+	Label     sql.NullString
+	RowsTotal sql.NullInt64
+	// NoHeader is set when the first line of the input is already an
+	// address row.
+	NoHeader       bool
+	MaxCalls       sql.NullInt64
+	MaxCostUSD     sql.NullFloat64
+	IdempotencyKey sql.NullString
+	ContentSHA256  sql.NullString
+	// ParentJobID and RetryRows are set for jobs re-running rows of a
+	// previous job.
+	ParentJobID sql.NullString
+	RetryRows   []int64
+}
+
+// Create inserts a job.
+func (r *Repository) Create(ctx context.Context, job NewJob) error {
+	return r.InTx(ctx, func(tx *Tx) error { return tx.Create(ctx, job) })
+}
+
+// Create inserts a job and records its initial status.
+func (tx *Tx) Create(ctx context.Context, job NewJob) error {
+	var retryRows any
+	if job.RetryRows != nil {
+		retryRows = pq.Array(job.RetryRows)
+	}
+	now := time.Now()
+	_, err := tx.ExecContext(ctx, `INSERT INTO jobs (id, status, input_path, api_key_id, label, rows_total, has_header, max_calls, max_cost_usd, idempotency_key, content_sha256, parent_job_id, retry_rows, created_at, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)`,
+		job.ID, job.Status, job.InputPath, job.APIKeyID, job.Label, job.RowsTotal, !job.NoHeader, job.MaxCalls, job.MaxCostUSD, job.IdempotencyKey, job.ContentSHA256, job.ParentJobID, retryRows, now, now)
+	if err != nil {
+		return err
+	}
+	return tx.recordEvent(ctx, job.ID, "", job.Status, "", now)
+}
+
+// Change holds what is stored along with a status transition.
+type Change struct {
+	// Fields are other jobs columns to set, by column name.
+	Fields map[string]any
+	// Message is recorded in the event, e.g. the reason a job failed.
+	Message string
+	// Owner, when set, is the worker that must own the job, as recorded in
+	// its worker_id column, for the transition to apply.
+	Owner string
+}
+
+// Transition moves a job to status to and returns the status it had.
+func (r *Repository) Transition(ctx context.Context, id string, to Status, change Change) (Status, error) {
+	var from Status
+	err := r.InTx(ctx, func(tx *Tx) error {
+		var err error
+		from, err = tx.Transition(ctx, id, to, change)
+		return err
+	})
+	return from, err
+}
+
+// Transition moves a job to status to and returns the status it had. The
+// job row is locked, so concurrent transitions of the same job are applied
+// one after the other and each one is checked against the status the
+// previous one left. It returns ErrInvalidTransition when the current
+// status does not allow to.
+func (tx *Tx) Transition(ctx context.Context, id string, to Status, change Change) (Status, error) {
+	var job struct {
+		Status   Status         `db:"status"`
+		WorkerID sql.NullString `db:"worker_id"`
+	}
+	err := tx.GetContext(ctx, &job, "SELECT status, worker_id FROM jobs WHERE id = $1 FOR UPDATE", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	from := job.Status
+	if change.Owner != "" && job.WorkerID.String != change.Owner {
+		return from, fmt.Errorf("%w: %s", ErrNotOwner, job.WorkerID.String)
+	}
+	if !CanTransition(from, to) {
+		return from, fmt.Errorf("%w: %s to %s", ErrInvalidTransition, from, to)
+	}
+
+	now := time.Now()
+	set := []string{"status = $1", "updated_at = $2"}
+	args := []any{to, now}
+	columns := make([]string, 0, len(change.Fields))
+	for column := range change.Fields {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	for _, column := range columns {
+		args = append(args, change.Fields[column])
+		set = append(set, column+" = $"+strconv.Itoa(len(args)))
+	}
+	args = append(args, id, from)
+	// The status condition is redundant with the lock but keeps the update
+	// safe on its own.
+	query := "UPDATE jobs SET " + strings.Join(set, ", ") + " WHERE id = $" + strconv.Itoa(len(args)-1) + " AND status = $" + strconv.Itoa(len(args))
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return from, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return from, fmt.Errorf("%w: %s to %s", ErrInvalidTransition, from, to)
+	}
+	return from, tx.recordEvent(ctx, id, from, to, change.Message, now)
+}
+
+// Reclaim makes this worker the owner of a PROCESSING job whose owner has
+// not sent a heartbeat, by touching updated_at, for longer than stale, and
+// records the takeover in job_events with reason. The job row is locked, so
+// the previous owner's ownership checks wait for the transaction.
+func (tx *Tx) Reclaim(ctx context.Context, id string, stale time.Duration, reason string) (bool, error) {
+	var job struct {
+		Status    Status         `db:"status"`
+		WorkerID  sql.NullString `db:"worker_id"`
+		UpdatedAt time.Time      `db:"updated_at"`
+	}
+	err := tx.GetContext(ctx, &job, "SELECT status, worker_id, updated_at FROM jobs WHERE id = $1 FOR UPDATE", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, ErrNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if job.Status != Processing || job.WorkerID.String == tx.workerID || now.Sub(job.UpdatedAt) < stale {
+		return false, nil
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE jobs SET worker_id = $1, updated_at = $2 WHERE id = $3", tx.workerID, now, id); err != nil {
+		return false, err
+	}
+	message := "reclaimed: " + reason
+	if job.WorkerID.Valid {
+		message = fmt.Sprintf("reclaimed from %s: %s", job.WorkerID.String, reason)
+	}
+	return true, tx.recordEvent(ctx, id, Processing, Processing, message, now)
+}
+
+// Heartbeat touches updated_at of a PROCESSING job owned by this worker. It
+// returns ErrNotOwner if the job is no longer PROCESSING or was reclaimed by
+// another worker.
+func (r *Repository) Heartbeat(ctx context.Context, id string) error {
+	res, err := r.db.ExecContext(ctx, "UPDATE jobs SET updated_at = $1 WHERE id = $2 AND status = $3 AND worker_id = $4", time.Now(), id, Processing, r.workerID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotOwner
+	}
+	return nil
+}
+
+// Own locks a job and returns ErrNotOwner unless it is PROCESSING and owned
+// by this worker, so the rest of the transaction only applies while it is.
+func (tx *Tx) Own(ctx context.Context, id string) error {
+	var owned bool
+	err := tx.GetContext(ctx, &owned, "SELECT status = $1 AND COALESCE(worker_id = $2, false) FROM jobs WHERE id = $3 FOR UPDATE", Processing, tx.workerID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !owned {
+		return ErrNotOwner
+	}
+	return nil
+}
+
+func (tx *Tx) recordEvent(ctx context.Context, id string, from, to Status, message string, at time.Time) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO job_events (job_id, from_status, to_status, worker_id, message, created_at) VALUES ($1, $2, $3, $4, $5, $6)",
+		id, sql.NullString{String: string(from), Valid: from != ""}, to, sql.NullString{String: tx.workerID, Valid: tx.workerID != ""},
+		sql.NullString{String: message, Valid: message != ""}, at)
+	return err
+}
+
+// Event is one recorded status change. FromStatus is NULL for the creation
+// of the job.
+type Event struct {
+	ID         int64          `db:"id"`
+	FromStatus sql.NullString `db:"from_status"`
+	ToStatus   Status         `db:"to_status"`
+	WorkerID   sql.NullString `db:"worker_id"`
+	Message    sql.NullString `db:"message"`
+	CreatedAt  time.Time      `db:"created_at"`
+}
+
+// History returns the status changes of a job, oldest first.
+func (r *Repository) History(ctx context.Context, id string) ([]Event, error) {
+	var events []Event
+	err := r.db.SelectContext(ctx, &events, "SELECT id, from_status, to_status, worker_id, message, created_at FROM job_events WHERE job_id = $1 ORDER BY created_at, id", id)
+	return events, err
+}
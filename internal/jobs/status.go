@@ -0,0 +1,69 @@
+// Package jobs stores jobs and enforces the transitions between their
+// statuses, recording each one in the job_events history.
+package jobs
+
+// Status is the lifecycle state of a job.
+type Status string
+
+const (
+	// AwaitingUpload jobs wait for their file to be uploaded to a presigned
+	// URL and for the start request.
+	AwaitingUpload Status = "AWAITING_UPLOAD"
+	// Pending jobs are stored with their message in the outbox but not yet
+	// published to the queue.
+	Pending Status = "PENDING"
+	// Queued jobs were published and wait for a worker.
+	Queued     Status = "QUEUED"
+	Processing Status = "PROCESSING"
+	Completed  Status = "COMPLETED"
+	// BudgetExceeded jobs stopped early because their own budget or their
+	// API key's monthly budget ran out; their partial result is kept.
+	BudgetExceeded Status = "BUDGET_EXCEEDED"
+	Failed         Status = "FAILED"
+	Cancelled      Status = "CANCELLED"
+	// Expired jobs had their files and result rows removed by retention.
+	Expired Status = "EXPIRED"
+)
+
+// transitions lists the statuses each status may move to.
+var transitions = map[Status][]Status{
+	AwaitingUpload: {Pending, Cancelled, Expired},
+	// A worker may receive a job before the relay marks it QUEUED.
+	Pending:        {Queued, Processing, Failed, Cancelled},
+	Queued:         {Processing, Failed, Cancelled},
+	Processing:     {Completed, BudgetExceeded, Failed, Cancelled},
+	Completed:      {Expired},
+	BudgetExceeded: {Expired},
+	Failed:         {Expired},
+	Cancelled:      {Expired},
+}
+
+// CanTransition reports whether a job may move from one status to another.
+func CanTransition(from, to Status) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Active reports whether a job is waiting for or being processed by a
+// worker.
+func (s Status) Active() bool {
+	return s == Pending || s == Queued || s == Processing
+}
+
+// Finished reports whether a job has stopped for good.
+func (s Status) Finished() bool {
+	switch s {
+	case Completed, BudgetExceeded, Failed, Cancelled, Expired:
+		return true
+	}
+	return false
+}
+
+// HasResult reports whether a job in this status offers a result file.
+func (s Status) HasResult() bool {
+	return s == Completed || s == BudgetExceeded
+}
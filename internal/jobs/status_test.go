@@ -0,0 +1,48 @@
+package jobs
+
+import "testing"
+
+func TestCanTransition(t *testing.T) {
+	statuses := []Status{AwaitingUpload, Pending, Queued, Processing, Completed, BudgetExceeded, Failed, Cancelled, Expired}
+	allowed := map[Status][]Status{
+		AwaitingUpload: {Pending, Cancelled, Expired},
+		Pending:        {Queued, Processing, Failed, Cancelled},
+		Queued:         {Processing, Failed, Cancelled},
+		Processing:     {Completed, BudgetExceeded, Failed, Cancelled},
+		Completed:      {Expired},
+		BudgetExceeded: {Expired},
+		Failed:         {Expired},
+		Cancelled:      {Expired},
+		Expired:        {},
+	}
+
+	for _, from := range statuses {
+		for _, to := range statuses {
+			want := false
+			for _, s := range allowed[from] {
+				if s == to {
+					want = true
+				}
+			}
+			if got := CanTransition(from, to); got != want {
+				t.Errorf("CanTransition(%s, %s) = %v, want %v", from, to, got, want)
+			}
+		}
+	}
+}
+
+func TestCanTransitionUnknownStatus(t *testing.T) {
+	tests := []struct {
+		from, to Status
+	}{
+		{"", Pending},
+		{Pending, ""},
+		{"DONE", Expired},
+		{Processing, "DONE"},
+	}
+	for _, tt := range tests {
+		if CanTransition(tt.from, tt.to) {
+			t.Errorf("CanTransition(%q, %q) = true, want false", tt.from, tt.to)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Package messages defines the messages exchanged through RabbitMQ between
+// the API and the workers.
+package messages
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+
+	"processador-de-enderecos/internal/decompress"
+)
+
+// JobVersion is the schema version of the JobMessage written by this code.
+// Version 2 added Chunk; version 1 messages are still accepted.
+const JobVersion = 2
+
+// ErrUnsupportedVersion is returned for a message whose schema version this
+// code does not know, e.g. one written by a newer API.
+var ErrUnsupportedVersion = errors.New("unsupported job message version")
+
+// JobMessage asks a worker to process a job. The job row in PostgreSQL stays
+// the source of truth; the message carries what the worker needs to start
+// and to correlate its logs.
+type JobMessage struct {
+	SchemaVersion int    `json:"schema_version"`
+	JobID         string `json:"job_id"`
+	// InputPath is the key of the input file in the uploads store.
+	InputPath string `json:"input_path"`
+	// Format is the compression format detected on upload; the worker
+	// refuses an input in another format. Empty means the worker only
+	// detects it, as for v0 messages.
+	Format decompress.Format `json:"format,omitempty"`
+	// Tenant is the id of the API key that owns the job. The worker's
+	// scheduler shares its slots fairly between tenants.
+	Tenant  string     `json:"tenant,omitempty"`
+	Options JobOptions `json:"options"`
+	// Trace is nil when the request carried no trace context.
+	Trace *Trace `json:"trace,omitempty"`
+	// Chunk is set on the messages of the chunks a large job is split into.
+	// InputPath is then the chunk's own input.
+	Chunk *ChunkRef `json:"chunk,omitempty"`
+}
+
+// ChunkRef identifies a chunk of a job.
+type ChunkRef struct {
+	Index int `json:"index"`
+	// FirstRow is the number, in the job's input, of the chunk's first row.
+	FirstRow int `json:"first_row"`
+	Rows     int `json:"rows"`
+}
+
+// JobOptions are the options the job was submitted with. The worker reads
+// the limits from the job row, the source of truth, and annotates its logs
+// with the label and parent job.
+type JobOptions struct {
+	Label       string  `json:"label,omitempty"`
+	MaxCalls    int64   `json:"max_calls,omitempty"`
+	MaxCostUSD  float64 `json:"max_cost_usd,omitempty"`
+	ParentJobID string  `json:"parent_job_id,omitempty"`
+}
+
+// Trace is the W3C trace context of the request that submitted the job. The
+// worker adds it to the logs of the job so they can be correlated with the
+// API's.
+type Trace struct {
+	Parent string `json:"traceparent,omitempty"`
+	State  string `json:"tracestate,omitempty"`
+}
+
+// NewJobMessage returns a message of the current version.
+func NewJobMessage(jobID, inputPath string) JobMessage {
+	return JobMessage{SchemaVersion: JobVersion, JobID: jobID, InputPath: inputPath}
+}
+
+// Encode serializes a message.
+func (m JobMessage) Encode() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// v0JobMessage is the message published before versioning:
+// {"job_id": "...", "caminho_csv": "uploads/<job>.csv"}.
+type v0JobMessage struct {
+	JobID      string `json:"job_id"`
+	CaminhoCSV string `json:"caminho_csv"`
+}
+
+// DecodeJobMessage parses and validates a message. Unknown fields are
+// rejected, messages without schema_version are read as v0 and unknown
+// versions return ErrUnsupportedVersion.
+func DecodeJobMessage(body []byte) (JobMessage, error) {
+	var header struct {
+		SchemaVersion *int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(body, &header); err != nil {
+		return JobMessage{}, fmt.Errorf("decoding job message: %w", err)
+	}
+
+	var m JobMessage
+	switch {
+	case header.SchemaVersion == nil:
+		var v0 v0JobMessage
+		if err := decodeStrict(body, &v0); err != nil {
+			return JobMessage{}, fmt.Errorf("decoding v0 job message: %w", err)
+		}
+		m = JobMessage{JobID: v0.JobID, InputPath: v0.CaminhoCSV}
+	case *header.SchemaVersion == 1 || *header.SchemaVersion == JobVersion:
+		if err := decodeStrict(body, &m); err != nil {
+			return JobMessage{}, fmt.Errorf("decoding v%d job message: %w", *header.SchemaVersion, err)
+		}
+		if m.SchemaVersion == 1 && m.Chunk != nil {
+			return JobMessage{}, errors.New("v1 job message has a chunk")
+		}
+	default:
+		return JobMessage{}, fmt.Errorf("%w: %d", ErrUnsupportedVersion, *header.SchemaVersion)
+	}
+
+	if _, err := uuid.Parse(m.JobID); err != nil {
+		return JobMessage{}, fmt.Errorf("invalid job_id %q", m.JobID)
+	}
+	if m.InputPath == "" {
+		return JobMessage{}, errors.New("job message has no input path")
+	}
+	switch m.Format {
+	case "", decompress.Plain, decompress.Gzip, decompress.Zstd, decompress.Zip:
+	default:
+		return JobMessage{}, fmt.Errorf("unknown input format %q", m.Format)
+	}
+	if m.Chunk != nil && (m.Chunk.Index < 0 || m.Chunk.FirstRow < 1 || m.Chunk.Rows < 1) {
+		return JobMessage{}, fmt.Errorf("invalid chunk %+v", *m.Chunk)
+	}
+	return m, nil
+}
+
+func decodeStrict(body []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("trailing data after message")
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package messages
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"processador-de-enderecos/internal/decompress"
+)
+
+const testJobID = "0b7e2a4c-5d1f-4c3e-9a8b-7f6e5d4c3b2a"
+
+func TestDecodeJobMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want JobMessage
+		// err is a substring of the expected error.
+		err string
+	}{
+		{
+			name: "v0 fallback",
+			body: `{"job_id": "` + testJobID + `", "caminho_csv": "uploads/x.csv"}`,
+			want: JobMessage{JobID: testJobID, InputPath: "uploads/x.csv"},
+		},
+		{
+			name: "v1",
+			body: `{"schema_version": 1, "job_id": "` + testJobID + `", "input_path": "uploads/x.csv.gz", "format": "gzip", "tenant": "k1", "options": {"label": "l", "max_calls": 10}}`,
+			want: JobMessage{SchemaVersion: 1, JobID: testJobID, InputPath: "uploads/x.csv.gz", Format: decompress.Gzip, Tenant: "k1", Options: JobOptions{Label: "l", MaxCalls: 10}},
+		},
+		{
+			name: "v2 with chunk and trace",
+			body: `{"schema_version": 2, "job_id": "` + testJobID + `", "input_path": "chunks/x/0.csv", "format": "plain", "options": {}, "trace": {"traceparent": "00-abc-def-01"}, "chunk": {"index": 0, "first_row": 1, "rows": 5}}`,
+			want: JobMessage{SchemaVersion: 2, JobID: testJobID, InputPath: "chunks/x/0.csv", Format: decompress.Plain, Trace: &Trace{Parent: "00-abc-def-01"}, Chunk: &ChunkRef{Index: 0, FirstRow: 1, Rows: 5}},
+		},
+		{
+			name: "unknown version",
+			body: `{"schema_version": 3, "job_id": "` + testJobID + `", "input_path": "uploads/x.csv"}`,
+			err:  "unsupported job message version: 3",
+		},
+		{
+			name: "unknown field",
+			body: `{"schema_version": 2, "job_id": "` + testJobID + `", "input_path": "uploads/x.csv", "priority": 5}`,
+			err:  `unknown field "priority"`,
+		},
+		{
+			name: "unknown v0 field",
+			body: `{"job_id": "` + testJobID + `", "caminho_csv": "uploads/x.csv", "extra": true}`,
+			err:  `unknown field "extra"`,
+		},
+		{
+			name: "v1 with chunk",
+			body: `{"schema_version": 1, "job_id": "` + testJobID + `", "input_path": "uploads/x.csv", "chunk": {"index": 0, "first_row": 1, "rows": 5}}`,
+			err:  "v1 job message has a chunk",
+		},
+		{
+			name: "invalid job id",
+			body: `{"schema_version": 2, "job_id": "42", "input_path": "uploads/x.csv"}`,
+			err:  `invalid job_id "42"`,
+		},
+		{
+			name: "missing input path",
+			body: `{"job_id": "` + testJobID + `"}`,
+			err:  "no input path",
+		},
+		{
+			name: "unknown format",
+			body: `{"schema_version": 2, "job_id": "` + testJobID + `", "input_path": "uploads/x.csv", "format": "bzip2"}`,
+			err:  `unknown input format "bzip2"`,
+		},
+		{
+			name: "invalid chunk",
+			body: `{"schema_version": 2, "job_id": "` + testJobID + `", "input_path": "chunks/x/0.csv", "chunk": {"index": 0, "first_row": 0, "rows": 5}}`,
+			err:  "invalid chunk",
+		},
+		{
+			name: "trailing data",
+			body: `{"schema_version": 2, "job_id": "` + testJobID + `", "input_path": "uploads/x.csv"} {}`,
+			err:  "decoding job message",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeJobMessage([]byte(tt.body))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("DecodeJobMessage() error = %v, want it to contain %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DecodeJobMessage() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("DecodeJobMessage() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeJobMessageUnsupportedVersion(t *testing.T) {
+	_, err := DecodeJobMessage([]byte(`{"schema_version": 99, "job_id": "` + testJobID + `"}`))
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("DecodeJobMessage() error = %v, want ErrUnsupportedVersion", err)
+	}
+}
+
+func TestJobMessageRoundTrip(t *testing.T) {
+	msg := NewJobMessage(testJobID, "uploads/x.csv")
+	msg.Format = decompress.Plain
+	msg.Tenant = "k1"
+
+	body, err := msg.Encode()
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if strings.Contains(string(body), `"trace"`) {
+		t.Errorf("Encode() = %s, want no trace without a trace context", body)
+	}
+	got, err := DecodeJobMessage(body)
+	if err != nil {
+		t.Fatalf("DecodeJobMessage() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, msg) {
+		t.Fatalf("DecodeJobMessage(Encode()) = %+v, want %+v", got, msg)
+	}
+}
@@ -0,0 +1,105 @@
+package migrate
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    []string
+		versions []int
+		err      string
+	}{
+		{
+			name:     "ordered by version",
+			files:    []string{"0010_b.up.sql", "0002_a.up.sql", "0002_a.down.sql", "0001_initial.up.sql"},
+			versions: []int{1, 2, 10},
+		},
+		{
+			name:  "missing direction",
+			files: []string{"0001_initial.sql"},
+			err:   "must end in .up.sql or .down.sql",
+		},
+		{
+			name:  "non-numeric version",
+			files: []string{"first_initial.up.sql"},
+			err:   `invalid version "first"`,
+		},
+		{
+			name:  "zero version",
+			files: []string{"0000_initial.up.sql"},
+			err:   `invalid version "0000"`,
+		},
+		{
+			name:  "negative version",
+			files: []string{"-1_initial.up.sql"},
+			err:   `invalid version "-1"`,
+		},
+		{
+			name:  "two names for a version",
+			files: []string{"0001_initial.up.sql", "0001_other.down.sql"},
+			err:   "migration 1 has two names",
+		},
+		{
+			name:  "down without up",
+			files: []string{"0001_initial.up.sql", "0002_a.down.sql"},
+			err:   "migration 2_a has no up script",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{}
+			for _, name := range tt.files {
+				fsys["migrations/"+name] = &fstest.MapFile{Data: []byte("SELECT 1;")}
+			}
+
+			migrations, err := load(fsys)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("load() error = %v, want it to contain %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("load() error = %v", err)
+			}
+			var versions []int
+			for _, m := range migrations {
+				versions = append(versions, m.Version)
+			}
+			if !equalInts(versions, tt.versions) {
+				t.Fatalf("load() versions = %v, want %v", versions, tt.versions)
+			}
+		})
+	}
+}
+
+func TestLoadEmbedded(t *testing.T) {
+	migrations, err := Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %d_%s: want version %d, versions must have no gaps", m.Version, m.Name, i+1)
+		}
+		if m.Down == "" {
+			t.Errorf("migration %d_%s has no down script", m.Version, m.Name)
+		}
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,6 @@
+ALTER TABLE jobs
+    DROP COLUMN IF EXISTS geocode_calls,
+    DROP COLUMN IF EXISTS nearby_search_calls,
+    DROP COLUMN IF EXISTS place_details_calls,
+    DROP COLUMN IF EXISTS cache_hits,
+    DROP COLUMN IF EXISTS cost_usd;
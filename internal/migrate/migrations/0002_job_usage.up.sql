@@ -0,0 +1,7 @@
+-- Google Maps usage of each job.
+ALTER TABLE jobs
+    ADD COLUMN IF NOT EXISTS geocode_calls INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS nearby_search_calls INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS place_details_calls INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS cache_hits INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS cost_usd NUMERIC(12, 4) NOT NULL DEFAULT 0;
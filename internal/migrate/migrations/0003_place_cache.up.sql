@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS place_cache (
+    address_key TEXT PRIMARY KEY,
+    result JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
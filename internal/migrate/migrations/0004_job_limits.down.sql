@@ -0,0 +1,6 @@
+ALTER TABLE jobs
+    DROP COLUMN IF EXISTS api_key_id,
+    DROP COLUMN IF EXISTS rows_total,
+    DROP COLUMN IF EXISTS rows_processed,
+    DROP COLUMN IF EXISTS max_calls,
+    DROP COLUMN IF EXISTS max_cost_usd;
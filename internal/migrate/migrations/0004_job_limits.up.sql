@@ -0,0 +1,7 @@
+-- Owner, progress and per-job call and cost limits.
+ALTER TABLE jobs
+    ADD COLUMN IF NOT EXISTS api_key_id VARCHAR(64),
+    ADD COLUMN IF NOT EXISTS rows_total INTEGER,
+    ADD COLUMN IF NOT EXISTS rows_processed INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS max_calls BIGINT,
+    ADD COLUMN IF NOT EXISTS max_cost_usd NUMERIC(12, 4);
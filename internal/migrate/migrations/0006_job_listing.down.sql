@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS jobs_api_key_id_label_created_at_idx;
+DROP INDEX IF EXISTS jobs_api_key_id_status_created_at_idx;
+DROP INDEX IF EXISTS jobs_api_key_id_created_at_idx;
+ALTER TABLE jobs DROP COLUMN IF EXISTS label;
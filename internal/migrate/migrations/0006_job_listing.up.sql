@@ -0,0 +1,6 @@
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS label VARCHAR(255);
+
+-- Job listing: keyset pagination per API key, optionally filtered by status or label.
+CREATE INDEX IF NOT EXISTS jobs_api_key_id_created_at_idx ON jobs (api_key_id, created_at, id);
+CREATE INDEX IF NOT EXISTS jobs_api_key_id_status_created_at_idx ON jobs (api_key_id, status, created_at, id);
+CREATE INDEX IF NOT EXISTS jobs_api_key_id_label_created_at_idx ON jobs (api_key_id, label, created_at, id) WHERE label IS NOT NULL;
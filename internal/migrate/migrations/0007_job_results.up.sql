@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS job_results (
+    job_id UUID NOT NULL REFERENCES jobs (id) ON DELETE CASCADE,
+    row_number INTEGER NOT NULL,
+    input TEXT[] NOT NULL,
+    address TEXT NOT NULL,
+    status VARCHAR(32) NOT NULL,
+    place_id VARCHAR(255),
+    name TEXT,
+    formatted_address TEXT,
+    phone VARCHAR(64),
+    website TEXT,
+    lat DOUBLE PRECISION,
+    lng DOUBLE PRECISION,
+    score REAL,
+    error TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (job_id, row_number)
+);
+
+CREATE INDEX IF NOT EXISTS job_results_job_id_status_row_number_idx ON job_results (job_id, status, row_number);
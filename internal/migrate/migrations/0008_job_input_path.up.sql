@@ -0,0 +1,2 @@
+-- Key of the input file in the uploads store.
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS input_path VARCHAR(255);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS jobs_api_key_id_content_sha256_idx;
+DROP INDEX IF EXISTS jobs_api_key_id_idempotency_key_idx;
+ALTER TABLE jobs
+    DROP COLUMN IF EXISTS idempotency_key,
+    DROP COLUMN IF EXISTS content_sha256;
@@ -0,0 +1,7 @@
+ALTER TABLE jobs
+    ADD COLUMN IF NOT EXISTS idempotency_key VARCHAR(255),
+    ADD COLUMN IF NOT EXISTS content_sha256 CHAR(64);
+
+-- Idempotent submission: one job per Idempotency-Key, and lookup of identical uploads.
+CREATE UNIQUE INDEX IF NOT EXISTS jobs_api_key_id_idempotency_key_idx ON jobs (api_key_id, idempotency_key) WHERE idempotency_key IS NOT NULL;
+CREATE INDEX IF NOT EXISTS jobs_api_key_id_content_sha256_idx ON jobs (api_key_id, content_sha256, created_at) WHERE content_sha256 IS NOT NULL;
@@ -0,0 +1,4 @@
+ALTER TABLE jobs
+    DROP COLUMN IF EXISTS merged_result_path,
+    DROP COLUMN IF EXISTS parent_job_id,
+    DROP COLUMN IF EXISTS retry_rows;
@@ -0,0 +1,5 @@
+-- Retry jobs re-run rows of a parent job; retry_rows maps their input rows to the parent's.
+ALTER TABLE jobs
+    ADD COLUMN IF NOT EXISTS merged_result_path VARCHAR(255),
+    ADD COLUMN IF NOT EXISTS parent_job_id UUID REFERENCES jobs (id) ON DELETE SET NULL,
+    ADD COLUMN IF NOT EXISTS retry_rows INTEGER[];
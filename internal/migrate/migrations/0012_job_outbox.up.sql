@@ -0,0 +1,19 @@
+-- Transactional outbox: messages written with the job and published by the relay.
+CREATE TABLE IF NOT EXISTS job_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    job_id UUID NOT NULL REFERENCES jobs (id) ON DELETE CASCADE,
+    queue VARCHAR(255) NOT NULL,
+    body BYTEA NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    sent_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS job_outbox_unsent_idx ON job_outbox (id) WHERE sent_at IS NULL;
+
+-- Jobs left PENDING by a failed publish before the outbox existed.
+INSERT INTO job_outbox (job_id, queue, body)
+SELECT id, 'jobs.queue', convert_to(json_build_object('job_id', id, 'caminho_csv', COALESCE(input_path, 'uploads/' || id || '.csv'))::text, 'UTF8')
+FROM jobs
+WHERE status = 'PENDING';
@@ -0,0 +1,3 @@
+UPDATE job_outbox SET queue = 'jobs.queue' WHERE sent_at IS NULL AND queue = 'jobs.tasks';
+
+ALTER TABLE job_outbox DROP COLUMN IF EXISTS priority;
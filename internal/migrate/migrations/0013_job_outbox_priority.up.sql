@@ -0,0 +1,4 @@
+-- Messages carry an AMQP priority and go to the priority queue jobs.tasks.
+ALTER TABLE job_outbox ADD COLUMN IF NOT EXISTS priority SMALLINT NOT NULL DEFAULT 0;
+
+UPDATE job_outbox SET queue = 'jobs.tasks' WHERE sent_at IS NULL AND queue = 'jobs.queue';
@@ -0,0 +1,21 @@
+-- Chunks of the large jobs split across workers, with their own progress.
+CREATE TABLE IF NOT EXISTS job_chunks (
+    job_id UUID NOT NULL REFERENCES jobs (id) ON DELETE CASCADE,
+    chunk_index INTEGER NOT NULL,
+    status VARCHAR(50) NOT NULL DEFAULT 'PENDING',
+    input_path TEXT NOT NULL,
+    result_path TEXT,
+    first_row INTEGER NOT NULL,
+    rows_total INTEGER NOT NULL,
+    rows_processed BIGINT NOT NULL DEFAULT 0,
+    geocode_calls BIGINT NOT NULL DEFAULT 0,
+    nearby_search_calls BIGINT NOT NULL DEFAULT 0,
+    place_details_calls BIGINT NOT NULL DEFAULT 0,
+    cache_hits BIGINT NOT NULL DEFAULT 0,
+    cost_usd NUMERIC(12, 4) NOT NULL DEFAULT 0,
+    error_message TEXT,
+    worker_id VARCHAR(255),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (job_id, chunk_index)
+);
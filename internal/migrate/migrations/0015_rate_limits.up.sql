@@ -0,0 +1,6 @@
+-- Token buckets shared by the worker replicas, e.g. one per Google endpoint.
+CREATE TABLE IF NOT EXISTS rate_limits (
+    name VARCHAR(255) PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,2 @@
+ALTER TABLE job_chunks DROP COLUMN IF EXISTS rate_stats;
+ALTER TABLE jobs DROP COLUMN IF EXISTS rate_stats;
@@ -0,0 +1,4 @@
+-- How the adaptive rate limiter treated each job: OVER_QUERY_LIMIT responses
+-- and the request rates allowed while it ran.
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS rate_stats JSONB;
+ALTER TABLE job_chunks ADD COLUMN IF NOT EXISTS rate_stats JSONB;
@@ -0,0 +1,3 @@
+-- Worker processing the job. It touches updated_at as a heartbeat, and
+-- another worker may reclaim the job once it stops.
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS worker_id VARCHAR(255);
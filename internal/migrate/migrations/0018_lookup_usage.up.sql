@@ -0,0 +1,11 @@
+-- Google Maps usage of lookups, made outside of any job, per API key and month.
+CREATE TABLE IF NOT EXISTS lookup_usage (
+    api_key_id VARCHAR(64) NOT NULL,
+    month DATE NOT NULL,
+    geocode_calls INTEGER NOT NULL DEFAULT 0,
+    nearby_search_calls INTEGER NOT NULL DEFAULT 0,
+    place_details_calls INTEGER NOT NULL DEFAULT 0,
+    cost_usd NUMERIC(12, 4) NOT NULL DEFAULT 0,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (api_key_id, month)
+);
@@ -0,0 +1,2 @@
+-- Whether the first line of the input is a header row, skipped by the worker.
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS has_header BOOLEAN NOT NULL DEFAULT true;
@@ -0,0 +1,2 @@
+-- Requests per minute allowed to each API key; NULL means unlimited.
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS requests_per_minute INTEGER;
@@ -0,0 +1 @@
+ALTER TABLE job_outbox DROP COLUMN IF EXISTS next_attempt_at;
@@ -0,0 +1,3 @@
+-- Messages that fail to publish are retried with backoff, so they do not
+-- hold back the messages after them.
+ALTER TABLE job_outbox ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMPTZ;
@@ -0,0 +1,204 @@
+// Package outbox publishes job messages through a transactional outbox: the
+// message is stored in job_outbox in the same transaction that creates or
+// starts the job, and a relay publishes it to RabbitMQ afterwards. A job that
+// is committed is therefore always published, even if the broker is down or
+// the process dies right after the commit.
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"processador-de-enderecos/internal/jobs"
+	"processador-de-enderecos/internal/messages"
+	"processador-de-enderecos/internal/rabbitmq"
+)
+
+const (
+	// maxAttempts is the number of times a message is published before the
+	// relay gives up on it and fails its job.
+	maxAttempts = 20
+	// maxRetryDelay caps the wait before a failed message is published
+	// again, which doubles after each attempt from a second. Messages are
+	// given up after about an hour.
+	maxRetryDelay = 5 * time.Minute
+)
+
+// EnqueueJob stores the message that sends a job of rows rows to the
+// workers. Smaller jobs get a higher priority, so interactive uploads are
+// not stuck behind large batches.
+func EnqueueJob(ctx context.Context, tx *jobs.Tx, msg messages.JobMessage, rows int64) error {
+	body, err := msg.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO job_outbox (job_id, queue, body, priority, created_at) VALUES ($1, $2, $3, $4, $5)",
+		msg.JobID, rabbitmq.JobQueue, body, Priority(rows), time.Now())
+	return err
+}
+
+// Priority returns the queue priority of a job of rows rows: MaxPriority up
+// to 100 rows, then one less for every tenfold increase, down to 1.
+func Priority(rows int64) uint8 {
+	p := rabbitmq.MaxPriority
+	for limit := int64(100); rows > limit && p > 1; limit *= 10 {
+		p--
+	}
+	return uint8(p)
+}
+
+// Publisher sends a message and returns once the broker confirmed it.
+type Publisher interface {
+	Publish(ctx context.Context, queue string, msg amqp.Publishing) error
+}
+
+// Relay publishes the stored messages and marks them sent. Several relays
+// may run at once; each message is locked by the one publishing it.
+type Relay struct {
+	repo      *jobs.Repository
+	publisher Publisher
+	interval  time.Duration
+	wake      chan struct{}
+	logger    *slog.Logger
+}
+
+// NewRelay returns a relay that publishes every interval or when woken with
+// Notify.
+func NewRelay(repo *jobs.Repository, publisher Publisher, interval time.Duration, logger *slog.Logger) *Relay {
+	return &Relay{
+		repo:      repo,
+		publisher: publisher,
+		interval:  interval,
+		wake:      make(chan struct{}, 1),
+		logger:    logger,
+	}
+}
+
+// Notify wakes the relay after a message was committed, so it is published
+// without waiting for the next poll.
+func (r *Relay) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run publishes messages until ctx is done.
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		for {
+			// Messages that fail to publish are retried later, so only
+			// database errors stop the relay until the next poll.
+			published, err := r.publishNext(ctx)
+			if err != nil {
+				r.logger.Error("Failed to relay job messages", "error", err)
+			}
+			if err != nil || !published {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.wake:
+		}
+	}
+}
+
+type message struct {
+	ID       int64  `db:"id"`
+	JobID    string `db:"job_id"`
+	Queue    string `db:"queue"`
+	Body     []byte `db:"body"`
+	Priority uint8  `db:"priority"`
+	Attempts int    `db:"attempts"`
+}
+
+// publishNext publishes the oldest unsent message due for an attempt and
+// reports whether there was one. Each message is published and marked sent
+// in its own short transaction, so the row locks and the connection held
+// while waiting for the broker are released after every message. A message
+// that fails to publish is retried with backoff, after the messages behind
+// it, and its job is failed after maxAttempts attempts.
+func (r *Relay) publishNext(ctx context.Context) (bool, error) {
+	var found bool
+	err := r.repo.InTx(ctx, func(tx *jobs.Tx) error {
+		var m message
+		now := time.Now()
+		err := tx.GetContext(ctx, &m, `SELECT id, job_id, queue, body, priority, attempts FROM job_outbox
+			WHERE sent_at IS NULL AND attempts < $1 AND (next_attempt_at IS NULL OR next_attempt_at <= $2) ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED`, maxAttempts, now)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+
+		if publishErr := r.publish(ctx, m); publishErr != nil {
+			return r.retryLater(ctx, tx, m, publishErr)
+		}
+
+		if _, err := tx.ExecContext(ctx, "UPDATE job_outbox SET sent_at = $1, attempts = attempts + 1 WHERE id = $2", time.Now(), m.ID); err != nil {
+			return err
+		}
+		// A worker may already have picked the job up.
+		_, err = tx.Transition(ctx, m.JobID, jobs.Queued, jobs.Change{})
+		if err != nil && !errors.Is(err, jobs.ErrInvalidTransition) && !errors.Is(err, jobs.ErrNotFound) {
+			return err
+		}
+		return nil
+	})
+	return found, err
+}
+
+// retryLater records a failed attempt at publishing m. The message is
+// published again after a delay, or given up along with its job once it
+// reaches maxAttempts.
+func (r *Relay) retryLater(ctx context.Context, tx *jobs.Tx, m message, publishErr error) error {
+	attempts := m.Attempts + 1
+	if attempts >= maxAttempts {
+		r.logger.Error("Giving up on job message", "job_id", m.JobID, "message_id", m.ID, "attempts", attempts, "error", publishErr)
+		if _, err := tx.ExecContext(ctx, "UPDATE job_outbox SET attempts = $1, last_error = $2 WHERE id = $3", attempts, publishErr.Error(), m.ID); err != nil {
+			return err
+		}
+		_, err := tx.Transition(ctx, m.JobID, jobs.Failed, jobs.Change{Fields: map[string]any{"error_message": publishErr.Error()}, Message: publishErr.Error()})
+		if err != nil && !errors.Is(err, jobs.ErrInvalidTransition) && !errors.Is(err, jobs.ErrNotFound) {
+			return err
+		}
+		return nil
+	}
+
+	delay := maxRetryDelay
+	if attempts <= 10 {
+		delay = min(time.Second<<(attempts-1), maxRetryDelay)
+	}
+	r.logger.Warn("Failed to publish job message, retrying later", "job_id", m.JobID, "message_id", m.ID, "attempts", attempts, "retry_in", delay, "error", publishErr)
+	_, err := tx.ExecContext(ctx, "UPDATE job_outbox SET attempts = $1, last_error = $2, next_attempt_at = $3 WHERE id = $4",
+		attempts, publishErr.Error(), time.Now().Add(delay), m.ID)
+	return err
+}
+
+// publish sends one message and waits for the broker to confirm it.
+func (r *Relay) publish(ctx context.Context, m message) error {
+	err := r.publisher.Publish(ctx, m.Queue, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Priority:     m.Priority,
+		Body:         m.Body,
+	})
+	if err != nil {
+		return fmt.Errorf("publishing message %d of job %s: %w", m.ID, m.JobID, err)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package output
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Export formats accepted by Export.
+const (
+	FormatJSONL    = "jsonl"
+	FormatNDJSONGz = "ndjson.gz"
+	FormatCSV      = "csv"
+	FormatGeoJSON  = "geojson"
+)
+
+// ContentTypes maps each export format to its HTTP content type.
+var ContentTypes = map[string]string{
+	FormatJSONL:    "application/jsonl",
+	FormatNDJSONGz: "application/gzip",
+	FormatCSV:      "text/csv",
+	FormatGeoJSON:  "application/geo+json",
+}
+
+// matchColumns are appended to the input columns in the flat CSV export.
+var matchColumns = []string{"row", "status", "place_id", "name", "formatted_address", "phone", "website", "lat", "lng", "score", "error"}
+
+// Export converts a JSONL result stream into the given format. inputColumns
+// names the input columns in the CSV export; when nil they are named after
+// their position.
+func Export(w io.Writer, r io.Reader, format string, inputColumns []string) error {
+	switch format {
+	case FormatJSONL:
+		_, err := io.Copy(w, r)
+		return err
+	case FormatNDJSONGz:
+		gz := gzip.NewWriter(w)
+		if _, err := io.Copy(gz, r); err != nil {
+			return err
+		}
+		return gz.Close()
+	case FormatCSV:
+		return exportCSV(w, r, inputColumns)
+	case FormatGeoJSON:
+		return exportGeoJSON(w, r)
+	default:
+		return fmt.Errorf("unsupported export format %q", format)
+	}
+}
+
+// eachRecord decodes a JSONL stream record by record.
+func eachRecord(r io.Reader, fn func(Record) error) error {
+	dec := json.NewDecoder(r)
+	for {
+		var rec Record
+		if err := dec.Decode(&rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+func exportCSV(w io.Writer, r io.Reader, inputColumns []string) error {
+	csvWriter := csv.NewWriter(w)
+	headerWritten := false
+	err := eachRecord(r, func(rec Record) error {
+		if !headerWritten {
+			if inputColumns == nil {
+				for i := range rec.Input {
+					inputColumns = append(inputColumns, "input_"+strconv.Itoa(i+1))
+				}
+				if len(inputColumns) == 0 {
+					inputColumns = []string{"address"}
+				}
+			}
+			if err := csvWriter.Write(append(append([]string(nil), inputColumns...), matchColumns...)); err != nil {
+				return err
+			}
+			headerWritten = true
+		}
+
+		row := make([]string, len(inputColumns), len(inputColumns)+len(matchColumns))
+		if rec.Input != nil {
+			copy(row, rec.Input)
+		} else {
+			row[0] = rec.Address
+		}
+		details := rec.Place()
+		var lat, lng string
+		if rec.Location != nil {
+			lat = strconv.FormatFloat(rec.Location.Lat, 'f', -1, 64)
+			lng = strconv.FormatFloat(rec.Location.Lng, 'f', -1, 64)
+		}
+		var rowNumber, score string
+		if rec.Row > 0 {
+			rowNumber = strconv.Itoa(rec.Row)
+		}
+		if rec.Score != nil {
+			score = strconv.FormatFloat(*rec.Score, 'f', -1, 64)
+		}
+		row = append(row, rowNumber, rec.EffectiveStatus(), rec.PlaceID, details.Name, details.FormattedAddress, details.Phone, details.Website, lat, lng, score, rec.Error)
+		return csvWriter.Write(row)
+	})
+	if err != nil {
+		return err
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+type geoJSONFeature struct {
+	Type       string            `json:"type"`
+	Geometry   geoJSONPoint      `json:"geometry"`
+	Properties geoJSONProperties `json:"properties"`
+}
+
+type geoJSONPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+type geoJSONProperties struct {
+	Row     int      `json:"row,omitempty"`
+	Address string   `json:"address"`
+	Status  string   `json:"status"`
+	PlaceID string   `json:"place_id,omitempty"`
+	Score   *float64 `json:"score,omitempty"`
+	PlaceFields
+}
+
+// exportGeoJSON writes a FeatureCollection with one point per geocoded row.
+// Rows that could not be geocoded have no coordinates and are left out.
+func exportGeoJSON(w io.Writer, r io.Reader) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(`{"type":"FeatureCollection","features":[`); err != nil {
+		return err
+	}
+	first := true
+	err := eachRecord(r, func(rec Record) error {
+		if rec.Location == nil {
+			return nil
+		}
+		feature := geoJSONFeature{
+			Type: "Feature",
+			Geometry: geoJSONPoint{
+				Type:        "Point",
+				Coordinates: [2]float64{rec.Location.Lng, rec.Location.Lat},
+			},
+			Properties: geoJSONProperties{
+				Row:         rec.Row,
+				Address:     rec.Address,
+				Status:      rec.EffectiveStatus(),
+				PlaceID:     rec.PlaceID,
+				Score:       rec.Score,
+				PlaceFields: rec.Place(),
+			},
+		}
+		b, err := json.Marshal(feature)
+		if err != nil {
+			return err
+		}
+		if !first {
+			if err := bw.WriteByte(','); err != nil {
+				return err
+			}
+		}
+		first = false
+		_, err = bw.Write(b)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := bw.WriteString("]}\n"); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,62 @@
+package output
+
+import (
+	"processador-de-enderecos/pkg/googlemaps"
+)
+
+// Record is one line of a job's JSONL result file.
+type Record struct {
+	// Row is the 1-based position of the address in the input, header excluded.
+	Row int `json:"row,omitempty"`
+	// Input holds every column of the input row.
+	Input    []string                       `json:"input,omitempty"`
+	Address  string                         `json:"address"`
+	PlaceID  string                         `json:"place_id,omitempty"`
+	Location *googlemaps.Location           `json:"location,omitempty"`
+	Details  *googlemaps.PlaceDetailsResult `json:"details,omitempty"`
+	// Score rates the match between 0 and 1 by how close the establishment
+	// is to the geocoded address.
+	Score  *float64 `json:"score,omitempty"`
+	Status string   `json:"status,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// StatusOK is reported for rows matched to an establishment, which carry
+// no status in the JSONL file.
+const StatusOK = "OK"
+
+// StatusError is reported for rows that failed with an error message.
+const StatusError = "ERROR"
+
+// EffectiveStatus returns the row status, filling in the implicit ones.
+func (r Record) EffectiveStatus() string {
+	switch {
+	case r.Status != "":
+		return r.Status
+	case r.Error != "":
+		return StatusError
+	default:
+		return StatusOK
+	}
+}
+
+// PlaceFields are the business fields flattened out of the place details.
+type PlaceFields struct {
+	Name             string `json:"name,omitempty"`
+	FormattedAddress string `json:"formatted_address,omitempty"`
+	Phone            string `json:"phone,omitempty"`
+	Website          string `json:"website,omitempty"`
+}
+
+// Place returns the matched business fields, empty when there is no match.
+func (r Record) Place() PlaceFields {
+	if r.Details == nil {
+		return PlaceFields{}
+	}
+	return PlaceFields{
+		Name:             r.Details.Result.Name,
+		FormattedAddress: r.Details.Result.FormattedAddress,
+		Phone:            r.Details.Result.InternationalPhoneNumber,
+		Website:          r.Details.Result.Website,
+	}
+}
@@ -0,0 +1,209 @@
+package processor
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+
+	"processador-de-enderecos/pkg/googlemaps"
+)
+
+// ErrBudgetExceeded is returned by the metered Maps client when a call would
+// go over the job or API key budget.
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// MonthlyLimits caps the Google usage of each API key per calendar month.
+// Zero values mean no limit. Limits set on the api_keys row take precedence.
+type MonthlyLimits struct {
+	MaxCalls   int64
+	MaxCostUSD float64
+}
+
+// override returns the limits with those set on an api_keys row replacing
+// the defaults.
+func (l MonthlyLimits) override(maxCalls sql.NullInt64, maxCostUSD sql.NullFloat64) MonthlyLimits {
+	if maxCalls.Valid {
+		l.MaxCalls = maxCalls.Int64
+	}
+	if maxCostUSD.Valid {
+		l.MaxCostUSD = maxCostUSD.Float64
+	}
+	return l
+}
+
+// budget holds the caps that apply to a single job run.
+type budget struct {
+	prices     googlemaps.PriceTable
+	apiKeyID   string
+	jobID      string
+	maxCalls   int64
+	maxCostUSD float64
+	monthly    MonthlyLimits
+	// chunk is the index of the chunk this run processes, or -1 when it
+	// processes the whole job.
+	chunk int
+
+	mu sync.Mutex
+	// Month-to-date usage of the API key by other jobs and by lookups.
+	otherCalls int64
+	otherCost  float64
+	// Usage of the job by its other chunks, which counts towards the job's
+	// own caps.
+	otherChunks googlemaps.CallCounts
+}
+
+// loadBudget reads the caps of a job and the month-to-date usage of its API
+// key. chunk is the index of the chunk being processed, or -1.
+func (p *JobProcessor) loadBudget(ctx context.Context, jobID string, chunk int) (*budget, error) {
+	var row struct {
+		APIKeyID          sql.NullString  `db:"api_key_id"`
+		MaxCalls          sql.NullInt64   `db:"max_calls"`
+		MaxCostUSD        sql.NullFloat64 `db:"max_cost_usd"`
+		MonthlyMaxCalls   sql.NullInt64   `db:"monthly_max_calls"`
+		MonthlyMaxCostUSD sql.NullFloat64 `db:"monthly_max_cost_usd"`
+	}
+	err := p.db.GetContext(ctx, &row, `SELECT j.api_key_id, j.max_calls, j.max_cost_usd, k.monthly_max_calls, k.monthly_max_cost_usd
+		FROM jobs j LEFT JOIN api_keys k ON k.id::text = j.api_key_id WHERE j.id = $1`, jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &budget{
+		prices:     p.prices,
+		apiKeyID:   row.APIKeyID.String,
+		jobID:      jobID,
+		maxCalls:   row.MaxCalls.Int64,
+		maxCostUSD: row.MaxCostUSD.Float64,
+		monthly:    p.monthlyLimits.override(row.MonthlyMaxCalls, row.MonthlyMaxCostUSD),
+		chunk:      chunk,
+	}
+	if err := b.refresh(ctx, p.db); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// refresh reloads the month-to-date usage of the API key by other jobs, which
+// includes the progress flushed by jobs still running, and by lookups, and
+// the usage of the job's other chunks. The latter counts towards both the
+// job's caps and the monthly caps, since the job itself is left out of the
+// month-to-date usage.
+func (b *budget) refresh(ctx context.Context, db *sqlx.DB) error {
+	if b.chunk >= 0 {
+		var chunks struct {
+			Geocode      int64 `db:"geocode_calls"`
+			NearbySearch int64 `db:"nearby_search_calls"`
+			PlaceDetails int64 `db:"place_details_calls"`
+		}
+		err := db.GetContext(ctx, &chunks, `SELECT COALESCE(SUM(geocode_calls), 0) AS geocode_calls, COALESCE(SUM(nearby_search_calls), 0) AS nearby_search_calls,
+			COALESCE(SUM(place_details_calls), 0) AS place_details_calls FROM job_chunks WHERE job_id = $1 AND chunk_index <> $2`, b.jobID, b.chunk)
+		if err != nil {
+			return err
+		}
+		b.mu.Lock()
+		b.otherChunks = googlemaps.CallCounts{Geocode: chunks.Geocode, NearbySearch: chunks.NearbySearch, PlaceDetails: chunks.PlaceDetails}
+		b.mu.Unlock()
+	}
+
+	if b.apiKeyID == "" || (b.monthly.MaxCalls == 0 && b.monthly.MaxCostUSD == 0) {
+		return nil
+	}
+	var spent struct {
+		Calls int64   `db:"calls"`
+		Cost  float64 `db:"cost"`
+	}
+	err := db.GetContext(ctx, &spent, `SELECT COALESCE(SUM(geocode_calls + nearby_search_calls + place_details_calls), 0) AS calls, COALESCE(SUM(cost_usd), 0) AS cost FROM (
+		SELECT geocode_calls, nearby_search_calls, place_details_calls, cost_usd FROM jobs WHERE api_key_id = $1 AND id::text <> $2 AND created_at >= date_trunc('month', NOW())
+		UNION ALL
+		SELECT geocode_calls, nearby_search_calls, place_details_calls, cost_usd FROM lookup_usage WHERE api_key_id = $1 AND month = date_trunc('month', NOW())::date) usage`, b.apiKeyID, b.jobID)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.otherCalls = spent.Calls
+	b.otherCost = spent.Cost
+	b.mu.Unlock()
+	return nil
+}
+
+// allow checks whether one more call to endpoint fits in the budget, given the
+// calls the run has already made.
+func (b *budget) allow(used googlemaps.CallCounts, endpoint googlemaps.Endpoint) error {
+	switch endpoint {
+	case googlemaps.EndpointGeocode:
+		used.Geocode++
+	case googlemaps.EndpointNearbySearch:
+		used.NearbySearch++
+	case googlemaps.EndpointPlaceDetails:
+		used.PlaceDetails++
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	used = used.Plus(b.otherChunks)
+	calls := used.Total()
+	cost := b.prices.Cost(used)
+
+	if b.maxCalls > 0 && calls > b.maxCalls {
+		return fmt.Errorf("%w: job limit of %d API calls reached", ErrBudgetExceeded, b.maxCalls)
+	}
+	if b.maxCostUSD > 0 && cost > b.maxCostUSD {
+		return fmt.Errorf("%w: job limit of %.2f USD reached", ErrBudgetExceeded, b.maxCostUSD)
+	}
+	if b.monthly.MaxCalls > 0 && b.otherCalls+calls > b.monthly.MaxCalls {
+		return fmt.Errorf("%w: monthly limit of %d API calls for this API key reached", ErrBudgetExceeded, b.monthly.MaxCalls)
+	}
+	if b.monthly.MaxCostUSD > 0 && b.otherCost+cost > b.monthly.MaxCostUSD {
+		return fmt.Errorf("%w: monthly limit of %.2f USD for this API key reached", ErrBudgetExceeded, b.monthly.MaxCostUSD)
+	}
+	return nil
+}
+
+// KeyBudget applies the monthly caps of an API key to calls made outside of
+// any job, such as lookups, and records those calls in the key's
+// month-to-date usage.
+type KeyBudget struct {
+	db     *sqlx.DB
+	budget *budget
+}
+
+// LoadKeyBudget reads the monthly caps of an API key, defaults unless the
+// api_keys row sets its own, and its month-to-date usage.
+func LoadKeyBudget(ctx context.Context, db *sqlx.DB, prices googlemaps.PriceTable, defaults MonthlyLimits, apiKeyID string) (*KeyBudget, error) {
+	var row struct {
+		MonthlyMaxCalls   sql.NullInt64   `db:"monthly_max_calls"`
+		MonthlyMaxCostUSD sql.NullFloat64 `db:"monthly_max_cost_usd"`
+	}
+	err := db.GetContext(ctx, &row, "SELECT monthly_max_calls, monthly_max_cost_usd FROM api_keys WHERE id::text = $1", apiKeyID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	b := &budget{
+		prices:   prices,
+		apiKeyID: apiKeyID,
+		monthly:  defaults.override(row.MonthlyMaxCalls, row.MonthlyMaxCostUSD),
+		chunk:    -1,
+	}
+	if err := b.refresh(ctx, db); err != nil {
+		return nil, err
+	}
+	return &KeyBudget{db: db, budget: b}, nil
+}
+
+// Record adds calls to the API key's usage for the current month.
+func (k *KeyBudget) Record(ctx context.Context, calls googlemaps.CallCounts) error {
+	if k.budget.apiKeyID == "" || calls.Total() == 0 {
+		return nil
+	}
+	_, err := k.db.ExecContext(ctx, `INSERT INTO lookup_usage (api_key_id, month, geocode_calls, nearby_search_calls, place_details_calls, cost_usd, updated_at)
+		VALUES ($1, date_trunc('month', NOW())::date, $2, $3, $4, $5, NOW())
+		ON CONFLICT (api_key_id, month) DO UPDATE SET geocode_calls = lookup_usage.geocode_calls + EXCLUDED.geocode_calls,
+		nearby_search_calls = lookup_usage.nearby_search_calls + EXCLUDED.nearby_search_calls, place_details_calls = lookup_usage.place_details_calls + EXCLUDED.place_details_calls,
+		cost_usd = lookup_usage.cost_usd + EXCLUDED.cost_usd, updated_at = EXCLUDED.updated_at`,
+		k.budget.apiKeyID, calls.Geocode, calls.NearbySearch, calls.PlaceDetails, k.budget.prices.Cost(calls))
+	return err
+}
@@ -0,0 +1,520 @@
+package processor
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"processador-de-enderecos/internal/decompress"
+	"processador-de-enderecos/internal/jobs"
+	"processador-de-enderecos/internal/messages"
+	"processador-de-enderecos/internal/outbox"
+	"processador-de-enderecos/pkg/googlemaps"
+)
+
+// Statuses of a row of job_chunks. Finished chunks take the status a job
+// would have; chunks that were never processed because the job stopped are
+// skipped.
+const (
+	chunkPending    = "PENDING"
+	chunkProcessing = "PROCESSING"
+	chunkSkipped    = "SKIPPED"
+)
+
+// jobChunk is a row of the job_chunks table.
+type jobChunk struct {
+	Index             int            `db:"chunk_index"`
+	Status            string         `db:"status"`
+	InputPath         string         `db:"input_path"`
+	ResultPath        sql.NullString `db:"result_path"`
+	FirstRow          int            `db:"first_row"`
+	RowsTotal         int            `db:"rows_total"`
+	RowsProcessed     int64          `db:"rows_processed"`
+	GeocodeCalls      int64          `db:"geocode_calls"`
+	NearbySearchCalls int64          `db:"nearby_search_calls"`
+	PlaceDetailsCalls int64          `db:"place_details_calls"`
+	CacheHits         int64          `db:"cache_hits"`
+	CostUSD           float64        `db:"cost_usd"`
+	ErrorMessage      sql.NullString `db:"error_message"`
+	RateStats         rateStats      `db:"rate_stats"`
+}
+
+// shouldSplit reports whether a job has more rows than a chunk, and whether
+// the first line of its input is a header row.
+func (p *JobProcessor) shouldSplit(ctx context.Context, jobID string) (split, header bool, err error) {
+	var job struct {
+		RowsTotal sql.NullInt64 `db:"rows_total"`
+		HasHeader bool          `db:"has_header"`
+	}
+	if err := p.db.GetContext(ctx, &job, "SELECT rows_total, has_header FROM jobs WHERE id = $1", jobID); err != nil {
+		return false, false, err
+	}
+	return p.chunkRows > 0 && job.RowsTotal.Int64 > int64(p.chunkRows), job.HasHeader, nil
+}
+
+// splitJob writes the input of a job as CSV files of chunkRows rows, each
+// with the input's header, then records the chunks and stores their messages
+// in the outbox in one transaction. The job stays PROCESSING until the last
+// chunk finishes.
+func (p *JobProcessor) splitJob(ctx context.Context, msg messages.JobMessage, header bool, jobLogger *slog.Logger) error {
+	input, err := p.openInput(ctx, msg.InputPath, msg.Format, jobLogger)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	var chunks []jobChunk
+	err = p.writeChunks(ctx, msg.JobID, input, header, func(c jobChunk) {
+		chunks = append(chunks, c)
+	})
+	if err == nil {
+		err = p.repo.InTx(ctx, func(tx *jobs.Tx) error {
+			// The job may have been reclaimed by another worker meanwhile.
+			if err := tx.Own(ctx, msg.JobID); err != nil {
+				return err
+			}
+			for _, c := range chunks {
+				_, err := tx.ExecContext(ctx, "INSERT INTO job_chunks (job_id, chunk_index, input_path, first_row, rows_total) VALUES ($1, $2, $3, $4, $5)",
+					msg.JobID, c.Index, c.InputPath, c.FirstRow, c.RowsTotal)
+				if err != nil {
+					return err
+				}
+				chunkMsg := msg
+				chunkMsg.SchemaVersion = messages.JobVersion
+				chunkMsg.InputPath = c.InputPath
+				chunkMsg.Format = decompress.Plain
+				chunkMsg.Chunk = &messages.ChunkRef{Index: c.Index, FirstRow: c.FirstRow, Rows: c.RowsTotal}
+				if err := outbox.EnqueueJob(ctx, tx, chunkMsg, int64(c.RowsTotal)); err != nil {
+					return err
+				}
+			}
+			// The chunks own the job from now on, until the worker finishing
+			// the last one takes it to finalize it.
+			_, err := tx.ExecContext(ctx, "UPDATE jobs SET worker_id = NULL WHERE id = $1", msg.JobID)
+			return err
+		})
+	}
+	if err != nil {
+		// A worker that reclaimed the job writes the same chunk files.
+		if !errors.Is(err, jobs.ErrNotOwner) {
+			for _, c := range chunks {
+				if err := p.uploads.Delete(ctx, c.InputPath); err != nil {
+					jobLogger.Warn("Failed to remove chunk input", "path", c.InputPath, "error", err)
+				}
+			}
+		}
+		return err
+	}
+	p.relay.Notify()
+
+	jobLogger.Info("Split job into chunks", "chunks", len(chunks), "chunk_rows", p.chunkRows)
+	return nil
+}
+
+// writeChunks uploads the chunks of input, calling add with each one stored.
+// Every chunk starts with a header row: the input's, or column names if
+// hasHeader is false.
+func (p *JobProcessor) writeChunks(ctx context.Context, jobID string, input io.Reader, hasHeader bool, add func(jobChunk)) error {
+	csvReader := csv.NewReader(input)
+	first, err := csvReader.Read()
+	if err != nil {
+		return fmt.Errorf("reading input: %w", err)
+	}
+	header := first
+	if !hasHeader {
+		header = make([]string, len(first))
+		for i := range header {
+			header[i] = fmt.Sprintf("column_%d", i+1)
+		}
+	}
+
+	for index, firstRow := 0, 1; ; index++ {
+		// Without a header the first line is the first row of chunk 0.
+		record := first
+		if hasHeader || index > 0 {
+			record, err = csvReader.Read()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading input: %w", err)
+		}
+
+		path := fmt.Sprintf("chunks/%s/%d.csv", jobID, index)
+		upload := startResultUpload(ctx, p.uploads, path, decompress.Plain.ContentType(), func(error) {})
+		w := csv.NewWriter(upload)
+		w.Write(header)
+		rows := 0
+		for {
+			w.Write(record)
+			rows++
+			if rows == p.chunkRows {
+				break
+			}
+			record, err = csvReader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				upload.Abort(err)
+				return fmt.Errorf("reading input: %w", err)
+			}
+		}
+		w.Flush()
+		// Write errors come from a failed upload, which Close reports.
+		if err := upload.Close(ctx); err != nil {
+			return fmt.Errorf("storing chunk %d: %w", index, err)
+		}
+		add(jobChunk{Index: index, InputPath: path, FirstRow: firstRow, RowsTotal: rows})
+		firstRow += rows
+	}
+}
+
+// ProcessChunk processes one chunk of a split job. The worker that finishes
+// the last chunk finalizes the job.
+func (p *JobProcessor) ProcessChunk(ctx context.Context, msg messages.JobMessage) {
+	jobID, index := msg.JobID, msg.Chunk.Index
+	chunkLogger := p.messageLogger(msg).With("chunk", index)
+
+	// Chunks of jobs that stopped, failed or ran out of budget meanwhile are
+	// skipped. A chunk PROCESSING under another worker is watched until that
+	// worker finishes it or stops sending heartbeats, like a job.
+	claimed, busy, err := p.claimChunk(ctx, jobID, index)
+	for waiting := false; err == nil && busy; {
+		if !waiting {
+			chunkLogger.Info("Chunk is being processed by another worker, waiting for it to finish or stop sending heartbeats")
+			waiting = true
+		}
+		if err = sleep(ctx, progressInterval); err != nil {
+			break
+		}
+		claimed, busy, err = p.claimChunk(ctx, jobID, index)
+	}
+	if err != nil {
+		chunkLogger.Error("Failed to claim chunk", "error", err)
+		return
+	}
+	if !claimed {
+		chunkLogger.Warn("Skipping chunk")
+		// The message may be the last one left of a job being finalized by
+		// another worker, which it takes over if that worker dies.
+		for waiting := false; p.finishChunk(ctx, msg, nil, chunkLogger); {
+			if !waiting {
+				chunkLogger.Info("Job is being finalized by another worker, waiting for it to finish or stop sending heartbeats")
+				waiting = true
+			}
+			if sleep(ctx, progressInterval) != nil {
+				return
+			}
+		}
+		return
+	}
+
+	// The chunk is processed under chunkCtx, cancelled if another worker
+	// reclaims it meanwhile.
+	chunkCtx, stopHeartbeat := p.heartbeat(ctx, func(ctx context.Context) error { return p.chunkHeartbeat(ctx, jobID, index) }, chunkLogger)
+	o, err := p.processChunk(chunkCtx, msg, chunkLogger)
+	stopHeartbeat()
+	if err != nil {
+		o = jobOutcome{status: jobs.Failed, errorMessage: sql.NullString{String: err.Error(), Valid: true}}
+	}
+	p.finishChunk(ctx, msg, &o, chunkLogger)
+}
+
+// claimChunk moves a chunk to PROCESSING, owned by this worker, if its job
+// is still being processed and none of its other chunks failed or ran out of
+// budget. Pending chunks can be claimed, and so can PROCESSING ones whose
+// worker died, i.e. whose heartbeat is older than jobLeaseTimeout. Chunks
+// that could be claimed but for the state of their job are skipped. busy
+// reports a chunk left PROCESSING under another live worker.
+func (p *JobProcessor) claimChunk(ctx context.Context, jobID string, index int) (claimed, busy bool, err error) {
+	now := time.Now()
+	claimable := "(c.status = $1 OR (c.status = $2 AND c.worker_id IS DISTINCT FROM $3 AND c.updated_at < $4))"
+	res, err := p.db.ExecContext(ctx, `UPDATE job_chunks c SET status = $2, worker_id = $3, updated_at = $5
+		FROM jobs j WHERE c.job_id = $6 AND c.chunk_index = $7 AND `+claimable+` AND j.id = c.job_id AND j.status = $8
+		AND NOT EXISTS (SELECT 1 FROM job_chunks o WHERE o.job_id = c.job_id AND o.status IN ($9, $10))`,
+		chunkPending, chunkProcessing, p.repo.WorkerID(), now.Add(-jobLeaseTimeout), now, jobID, index, jobs.Processing, jobs.Failed, jobs.BudgetExceeded)
+	if err != nil {
+		return false, false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 1 {
+		return n == 1, false, err
+	}
+	_, err = p.db.ExecContext(ctx, `UPDATE job_chunks c SET status = $5, updated_at = $6 WHERE c.job_id = $7 AND c.chunk_index = $8 AND `+claimable+`
+		AND (NOT EXISTS (SELECT 1 FROM jobs j WHERE j.id = c.job_id AND j.status = $9)
+		OR EXISTS (SELECT 1 FROM job_chunks o WHERE o.job_id = c.job_id AND o.status IN ($10, $11)))`,
+		chunkPending, chunkProcessing, p.repo.WorkerID(), now.Add(-jobLeaseTimeout), chunkSkipped, now, jobID, index, jobs.Processing, jobs.Failed, jobs.BudgetExceeded)
+	if err != nil {
+		return false, false, err
+	}
+	err = p.db.GetContext(ctx, &busy, "SELECT EXISTS (SELECT 1 FROM job_chunks WHERE job_id = $1 AND chunk_index = $2 AND status = $3 AND worker_id IS DISTINCT FROM $4)",
+		jobID, index, chunkProcessing, p.repo.WorkerID())
+	return false, busy, err
+}
+
+// chunkHeartbeat touches a chunk processed by this worker. It returns
+// jobs.ErrNotOwner if another worker reclaimed it.
+func (p *JobProcessor) chunkHeartbeat(ctx context.Context, jobID string, index int) error {
+	res, err := p.db.ExecContext(ctx, "UPDATE job_chunks SET updated_at = $1 WHERE job_id = $2 AND chunk_index = $3 AND status = $4 AND worker_id = $5",
+		time.Now(), jobID, index, chunkProcessing, p.repo.WorkerID())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return jobs.ErrNotOwner
+	}
+	return nil
+}
+
+// processChunk runs the rows of a claimed chunk.
+func (p *JobProcessor) processChunk(ctx context.Context, msg messages.JobMessage, chunkLogger *slog.Logger) (jobOutcome, error) {
+	jobID, chunk := msg.JobID, msg.Chunk
+	chunkBudget, err := p.loadBudget(ctx, jobID, chunk.Index)
+	if err != nil {
+		chunkLogger.Error("Failed to load job budget", "error", err)
+		return jobOutcome{}, err
+	}
+	retry, err := p.loadRetry(ctx, jobID)
+	if err != nil {
+		chunkLogger.Error("Failed to load retry parent", "error", err)
+		return jobOutcome{}, err
+	}
+	input, err := p.openInput(ctx, msg.InputPath, msg.Format, chunkLogger)
+	if err != nil {
+		return jobOutcome{}, err
+	}
+	defer input.Close()
+
+	resultPath := fmt.Sprintf("chunks/%s/%d.jsonl", jobID, chunk.Index)
+	res := p.processRows(ctx, rowsRun{
+		jobID:      jobID,
+		input:      input,
+		header:     true,
+		firstRow:   chunk.FirstRow,
+		retry:      retry,
+		budget:     chunkBudget,
+		resultPath: resultPath,
+		flush: func(run *jobRun) {
+			calls := run.maps.usage.Counts()
+			p.flushChunkProgress(ctx, jobID, chunk.Index, jobOutcome{
+				rowsProcessed: run.rowsProcessed.Load(),
+				calls:         calls,
+				cacheHits:     run.cacheHits.Load(),
+				cost:          p.prices.Cost(calls),
+				rates:         run.maps.rateStats(),
+			})
+		},
+		logger: chunkLogger,
+	})
+	o := res.outcome(resultPath)
+	chunkLogger.Info("Chunk finished", "status", o.status, "rows_processed", o.rowsProcessed, "api_calls", o.calls.Total())
+	return o, nil
+}
+
+// flushChunkProgress stores the counters of a chunk and adds up the chunks
+// into the job's, so the job's progress and spend stay visible.
+func (p *JobProcessor) flushChunkProgress(ctx context.Context, jobID string, index int, o jobOutcome) {
+	_, err := p.db.ExecContext(ctx, `UPDATE job_chunks SET rows_processed = $1, geocode_calls = $2, nearby_search_calls = $3, place_details_calls = $4, cache_hits = $5, cost_usd = $6, rate_stats = $7,
+		updated_at = $8 WHERE job_id = $9 AND chunk_index = $10 AND status = $11 AND worker_id = $12`,
+		o.rowsProcessed, o.calls.Geocode, o.calls.NearbySearch, o.calls.PlaceDetails, o.cacheHits, o.cost, o.rates, time.Now(), jobID, index, chunkProcessing, p.repo.WorkerID())
+	if err == nil {
+		err = p.sumChunkProgress(ctx, jobID)
+	}
+	if err != nil {
+		p.logger.Warn("Failed to flush chunk progress", "job_id", jobID, "chunk", index, "error", err)
+	}
+}
+
+func (p *JobProcessor) sumChunkProgress(ctx context.Context, jobID string) error {
+	_, err := p.db.ExecContext(ctx, `UPDATE jobs SET (rows_processed, geocode_calls, nearby_search_calls, place_details_calls, cache_hits, cost_usd) =
+		(SELECT SUM(rows_processed), SUM(geocode_calls), SUM(nearby_search_calls), SUM(place_details_calls), SUM(cache_hits), SUM(cost_usd) FROM job_chunks WHERE job_id = $1),
+		updated_at = $2 WHERE id = $1`, jobID, time.Now())
+	return err
+}
+
+// finishChunk stores the outcome of a chunk, if it was processed and is
+// still owned by this worker, and finalizes the job when no chunk is left.
+// The job row is locked while counting, and the worker finalizing the job
+// takes ownership of it in the same transaction, so a single call finalizes
+// it. Once the finalizing worker stops sending heartbeats, a call without an
+// outcome takes over the finalization; until then it returns true.
+func (p *JobProcessor) finishChunk(ctx context.Context, msg messages.JobMessage, o *jobOutcome, chunkLogger *slog.Logger) (finalizing bool) {
+	jobID, index := msg.JobID, msg.Chunk.Index
+	var left int
+	var processing, finalize bool
+	err := p.repo.InTx(ctx, func(tx *jobs.Tx) error {
+		var job struct {
+			Status   jobs.Status    `db:"status"`
+			WorkerID sql.NullString `db:"worker_id"`
+		}
+		if err := tx.GetContext(ctx, &job, "SELECT status, worker_id FROM jobs WHERE id = $1 FOR UPDATE", jobID); err != nil {
+			return err
+		}
+		if o != nil {
+			res, err := tx.ExecContext(ctx, `UPDATE job_chunks SET status = $1, result_path = $2, error_message = $3, rows_processed = $4, geocode_calls = $5, nearby_search_calls = $6,
+				place_details_calls = $7, cache_hits = $8, cost_usd = $9, rate_stats = $10, updated_at = $11 WHERE job_id = $12 AND chunk_index = $13 AND status = $14 AND worker_id = $15`,
+				o.status, o.resultPath, o.errorMessage, o.rowsProcessed, o.calls.Geocode, o.calls.NearbySearch, o.calls.PlaceDetails, o.cacheHits, o.cost, o.rates, time.Now(), jobID, index,
+				chunkProcessing, p.repo.WorkerID())
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				return jobs.ErrNotOwner
+			}
+		}
+		if err := tx.GetContext(ctx, &left, "SELECT COUNT(*) FROM job_chunks WHERE job_id = $1 AND status IN ($2, $3)", jobID, chunkPending, chunkProcessing); err != nil {
+			return err
+		}
+		processing = job.Status == jobs.Processing
+		if left > 0 || !processing {
+			return nil
+		}
+		if !job.WorkerID.Valid {
+			_, err := tx.ExecContext(ctx, "UPDATE jobs SET worker_id = $1, updated_at = $2 WHERE id = $3", p.repo.WorkerID(), time.Now(), jobID)
+			finalize = err == nil
+			return err
+		}
+		var err error
+		finalize, err = tx.Reclaim(ctx, jobID, jobLeaseTimeout, "finalization interrupted")
+		finalizing = err == nil && !finalize
+		return err
+	})
+	if errors.Is(err, jobs.ErrNotOwner) {
+		chunkLogger.Warn("Chunk was reclaimed by another worker, dropping its outcome")
+		return false
+	}
+	if err != nil {
+		chunkLogger.Error("Failed to store chunk status", "error", err)
+		return false
+	}
+	if o != nil && left > 0 {
+		if err := p.sumChunkProgress(ctx, jobID); err != nil {
+			chunkLogger.Warn("Failed to flush chunk progress", "error", err)
+		}
+	}
+	if left == 0 && (finalize || !processing) {
+		p.finalizeJob(ctx, jobID, finalize)
+	}
+	return finalizing
+}
+
+// finalizeJob removes the chunk files of a job once no chunk is left. If
+// merge is set, this worker owns the job: it first concatenates the chunk
+// results, in row order, into the job's result and moves the job to its
+// final status. Otherwise the job is no longer PROCESSING, e.g. it was
+// cancelled, and only the chunk files are removed.
+func (p *JobProcessor) finalizeJob(ctx context.Context, jobID string, merge bool) {
+	jobLogger := p.logger.With("job_id", jobID)
+
+	var chunks []jobChunk
+	err := p.db.SelectContext(ctx, &chunks, `SELECT chunk_index, status, input_path, result_path, first_row, rows_total, rows_processed, geocode_calls, nearby_search_calls,
+		place_details_calls, cache_hits, cost_usd, error_message, rate_stats FROM job_chunks WHERE job_id = $1 ORDER BY chunk_index`, jobID)
+	if err != nil {
+		jobLogger.Error("Failed to load job chunks", "error", err)
+		return
+	}
+
+	if merge {
+		jobCtx, stopHeartbeat := p.heartbeat(ctx, func(ctx context.Context) error { return p.repo.Heartbeat(ctx, jobID) }, jobLogger)
+		retry, err := p.loadRetry(jobCtx, jobID)
+		if err != nil {
+			stopHeartbeat()
+			jobLogger.Error("Failed to load retry parent", "error", err)
+			p.updateJobStatusToFailed(ctx, jobID, p.repo.WorkerID(), err)
+			return
+		}
+		o := p.mergeChunks(jobCtx, jobID, chunks, jobLogger)
+		stopHeartbeat()
+		if jobCtx.Err() == nil {
+			p.completeJob(ctx, jobID, retry, o, p.repo.WorkerID(), jobLogger)
+		} else {
+			// The job was cancelled meanwhile, or reclaimed by another
+			// worker, which then finalizes it and needs the chunk files.
+			var status jobs.Status
+			if err := p.db.GetContext(ctx, &status, "SELECT status FROM jobs WHERE id = $1", jobID); err != nil || status == jobs.Processing {
+				return
+			}
+		}
+	}
+
+	for _, c := range chunks {
+		if err := p.uploads.Delete(ctx, c.InputPath); err != nil {
+			jobLogger.Warn("Failed to remove chunk input", "path", c.InputPath, "error", err)
+		}
+		if c.ResultPath.Valid {
+			if err := p.results.Delete(ctx, c.ResultPath.String); err != nil {
+				jobLogger.Warn("Failed to remove chunk result", "path", c.ResultPath.String, "error", err)
+			}
+		}
+	}
+}
+
+// mergeChunks writes the job result from the chunk results and returns the
+// job's outcome: failed if a chunk failed, over budget if a chunk ran out of
+// budget or was skipped, completed otherwise.
+func (p *JobProcessor) mergeChunks(ctx context.Context, jobID string, chunks []jobChunk, jobLogger *slog.Logger) jobOutcome {
+	o := jobOutcome{status: jobs.Completed}
+	for _, c := range chunks {
+		o.rowsProcessed += c.RowsProcessed
+		o.calls = o.calls.Plus(googlemaps.CallCounts{Geocode: c.GeocodeCalls, NearbySearch: c.NearbySearchCalls, PlaceDetails: c.PlaceDetailsCalls})
+		o.cacheHits += c.CacheHits
+		o.rates.merge(c.RateStats)
+
+		switch {
+		case c.Status == string(jobs.Failed) && o.status != jobs.Failed:
+			o.status = jobs.Failed
+			o.errorMessage = sql.NullString{String: fmt.Sprintf("chunk %d: %s", c.Index, c.ErrorMessage.String), Valid: true}
+		case (c.Status == string(jobs.BudgetExceeded) || c.Status == chunkSkipped) && o.status != jobs.Failed:
+			o.status = jobs.BudgetExceeded
+			if !o.errorMessage.Valid {
+				o.errorMessage = c.ErrorMessage
+			}
+		}
+	}
+	o.cost = p.prices.Cost(o.calls)
+
+	resultPath := "results/" + jobID + ".jsonl"
+	upload := startResultUpload(ctx, p.results, resultPath, "application/jsonl", func(error) {})
+	var copyErr error
+	for _, c := range chunks {
+		if !c.ResultPath.Valid {
+			continue
+		}
+		if copyErr = p.copyResult(ctx, upload, c.ResultPath.String); copyErr != nil {
+			break
+		}
+	}
+	// A failed copy aborts the upload, so an existing result is not replaced
+	// with a truncated one.
+	var uploadErr error
+	if copyErr != nil {
+		upload.Abort(copyErr)
+		uploadErr = fmt.Errorf("merging chunk results: %w", copyErr)
+	} else {
+		uploadErr = upload.Close(ctx)
+	}
+	if uploadErr != nil {
+		jobLogger.Error("Failed to upload result file", "path", resultPath, "error", uploadErr)
+		o.status = jobs.Failed
+		o.errorMessage = sql.NullString{String: uploadErr.Error(), Valid: true}
+		return o
+	}
+	o.resultPath = sql.NullString{String: resultPath, Valid: true}
+	return o
+}
+
+func (p *JobProcessor) copyResult(ctx context.Context, w io.Writer, path string) error {
+	object, err := p.results.Get(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+	_, err = io.Copy(w, object)
+	return err
+}
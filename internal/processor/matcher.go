@@ -0,0 +1,227 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"sync"
+
+	addr "processador-de-enderecos/internal/address"
+	"processador-de-enderecos/internal/cache"
+	"processador-de-enderecos/internal/output"
+	"processador-de-enderecos/pkg/googlemaps"
+)
+
+// Matcher finds the establishment at an address. It is shared by batch jobs
+// and single-address lookups so both use the same pipeline and place cache.
+type Matcher struct {
+	client     *googlemaps.Client
+	placeCache *cache.PlaceCache
+	logger     *slog.Logger
+}
+
+// NewMatcher creates a new Matcher. placeCache may be nil to disable caching.
+func NewMatcher(client *googlemaps.Client, placeCache *cache.PlaceCache, logger *slog.Logger) *Matcher {
+	return &Matcher{
+		client:     client,
+		placeCache: placeCache,
+		logger:     logger,
+	}
+}
+
+// Lookup matches addresses outside of any job, with up to maxConcurrency
+// addresses in flight, within the monthly budget of the caller's API key.
+// Results are in input order, with Row set to the 1-based position of each
+// address. Addresses refused by the budget are marked BUDGET_EXCEEDED and
+// the reason is returned; the calls made are recorded in the key's usage.
+func (m *Matcher) Lookup(ctx context.Context, addresses []string, maxConcurrency int, keyBudget *KeyBudget) ([]output.Record, googlemaps.CallCounts, error) {
+	maps := &meteredMaps{client: m.client, usage: &googlemaps.Usage{}, budget: keyBudget.budget}
+	var budgetErr error
+	var budgetOnce sync.Once
+	records := make([]output.Record, len(addresses))
+	sem := make(chan struct{}, maxConcurrency)
+	var wg sync.WaitGroup
+	for i, address := range addresses {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, address string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			record, _, err := m.match(ctx, maps, address)
+			if err != nil {
+				budgetOnce.Do(func() { budgetErr = err })
+			}
+			record.Row = i + 1
+			record.Address = address
+			records[i] = record
+		}(i, address)
+	}
+	wg.Wait()
+	calls := maps.usage.Counts()
+	// The lookup may have timed out, the calls were made anyway.
+	if err := keyBudget.Record(context.WithoutCancel(ctx), calls); err != nil {
+		m.logger.Error("Failed to record lookup usage", "api_key_id", keyBudget.budget.apiKeyID, "error", err)
+	}
+	return records, calls, budgetErr
+}
+
+// match returns the cached result for an address or resolves it with Google,
+// caching definitive answers. cached reports whether the cache was used.
+func (m *Matcher) match(ctx context.Context, maps *meteredMaps, address string) (result output.Record, cached bool, err error) {
+	key := addr.Key(address)
+	if result, ok := m.cachedResult(ctx, key); ok {
+		return result, true, nil
+	}
+	result, err = m.resolve(ctx, maps, address)
+	if err == nil && isCacheable(result) {
+		m.storeResult(ctx, key, result)
+	}
+	return result, false, err
+}
+
+// resolve runs the geocode -> nearby search -> place details pipeline for a
+// single address. The error is only set when the job's budget is exhausted;
+// the returned result then marks the row as BUDGET_EXCEEDED.
+func (m *Matcher) resolve(ctx context.Context, maps *meteredMaps, address string) (output.Record, error) {
+	// Step 1: Geocode the address to get coordinates and a fallback place_id
+	geocodeResponse, err := maps.Geocode(ctx, address)
+	if errors.Is(err, ErrBudgetExceeded) {
+		return output.Record{Address: address, Status: "BUDGET_EXCEEDED"}, err
+	}
+	if err != nil {
+		m.logger.Warn("Failed to geocode address", "address", address, "error", err)
+		return output.Record{Address: address, Error: err.Error()}, nil
+	}
+
+	if geocodeResponse.Status == "ZERO_RESULTS" || len(geocodeResponse.Results) == 0 {
+		return output.Record{Address: address, Status: "NO_RESULTS_FOUND"}, nil
+	}
+
+	// Use the first result for coordinates and as a fallback
+	firstResult := geocodeResponse.Results[0]
+	location := firstResult.Geometry.Location
+	lat := location.Lat
+	lng := location.Lng
+	fallbackPlaceID := firstResult.PlaceID
+
+	// Step 2: Perform a Nearby Search for establishments
+	nearbyResponse, err := maps.NearbySearch(ctx, lat, lng, 25) // 25-meter radius
+	if errors.Is(err, ErrBudgetExceeded) {
+		return output.Record{Address: address, PlaceID: fallbackPlaceID, Location: &location, Status: "BUDGET_EXCEEDED"}, err
+	}
+	if err != nil {
+		m.logger.Warn("Nearby Search failed", "address", address, "lat", lat, "lng", lng, "error", err)
+		return output.Record{Address: address, PlaceID: fallbackPlaceID, Location: &location, Status: "NEARBY_SEARCH_FAILED"}, nil
+	}
+
+	var establishmentPlaceID string
+	var establishmentLocation googlemaps.Location
+	if nearbyResponse.Status == "OK" && len(nearbyResponse.Results) > 0 {
+		// Find the first result that is explicitly a business
+		for _, place := range nearbyResponse.Results {
+			isBusiness := false
+			for _, t := range place.Types {
+				// Check for common business-related types.
+				if t == "establishment" || t == "point_of_interest" || t == "store" || t == "supermarket" || t == "restaurant" {
+					isBusiness = true
+					break
+				}
+			}
+			if isBusiness {
+				establishmentPlaceID = place.PlaceID
+				establishmentLocation = place.Geometry.Location
+				break // Found a good candidate, stop searching
+			}
+		}
+	}
+
+	// Step 3: Get details if an establishment was found
+	if establishmentPlaceID != "" {
+		detailsResult, err := maps.GetPlaceDetails(ctx, establishmentPlaceID)
+		if errors.Is(err, ErrBudgetExceeded) {
+			return output.Record{Address: address, PlaceID: establishmentPlaceID, Location: &location, Status: "BUDGET_EXCEEDED"}, err
+		}
+		if err != nil {
+			m.logger.Warn("Failed to get place details for establishment", "address", address, "place_id", establishmentPlaceID, "error", err)
+			return output.Record{Address: address, PlaceID: establishmentPlaceID, Location: &location, Status: "GET_DETAILS_FAILED"}, nil
+		}
+		score := matchScore(location, establishmentLocation, 25)
+		return output.Record{
+			Address:  address,
+			PlaceID:  establishmentPlaceID,
+			Location: &location,
+			Details:  detailsResult,
+			Score:    &score,
+		}, nil
+	}
+
+	// If no establishment was found nearby, output the fallback
+	return output.Record{
+		Address:  address,
+		PlaceID:  fallbackPlaceID,
+		Location: &location,
+		Status:   "NO_ESTABLISHMENT_FOUND",
+	}, nil
+}
+
+// matchScore rates an establishment between 0 and 1 by its distance to the
+// geocoded address, relative to the search radius in meters.
+func matchScore(address, establishment googlemaps.Location, radius float64) float64 {
+	const earthRadius = 6371000 // meters
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(establishment.Lat - address.Lat)
+	dLng := toRad(establishment.Lng - address.Lng)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(address.Lat))*math.Cos(toRad(establishment.Lat))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	distance := 2 * earthRadius * math.Asin(math.Sqrt(a))
+	score := 1 - distance/radius
+	if score < 0 {
+		return 0
+	}
+	return math.Round(score*1000) / 1000
+}
+
+// isCacheable reports whether a result is a definitive answer from Google,
+// as opposed to a transient failure that should be retried next time.
+func isCacheable(result output.Record) bool {
+	switch result.EffectiveStatus() {
+	case output.StatusOK, "NO_RESULTS_FOUND", "NO_ESTABLISHMENT_FOUND":
+		return true
+	}
+	return false
+}
+
+func (m *Matcher) cachedResult(ctx context.Context, key string) (output.Record, bool) {
+	if m.placeCache == nil {
+		return output.Record{}, false
+	}
+	raw, ok, err := m.placeCache.Get(ctx, key)
+	if err != nil {
+		m.logger.Warn("Failed to read place cache", "error", err)
+		return output.Record{}, false
+	}
+	if !ok {
+		return output.Record{}, false
+	}
+	var result output.Record
+	if err := json.Unmarshal(raw, &result); err != nil {
+		m.logger.Warn("Failed to decode cached result", "error", err)
+		return output.Record{}, false
+	}
+	return result, true
+}
+
+func (m *Matcher) storeResult(ctx context.Context, key string, result output.Record) {
+	if m.placeCache == nil {
+		return
+	}
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+	if err := m.placeCache.Set(ctx, key, raw); err != nil {
+		m.logger.Warn("Failed to write place cache", "error", err)
+	}
+}
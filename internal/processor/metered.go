@@ -0,0 +1,141 @@
+package processor
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"processador-de-enderecos/pkg/googlemaps"
+)
+
+// meteredMaps wraps the shared Google Maps client, counts the calls made on
+// behalf of a single job and refuses calls that would exceed its budget.
+type meteredMaps struct {
+	client *googlemaps.Client
+	usage  *googlemaps.Usage
+	budget *budget
+
+	// mu makes the budget check and the usage increment atomic, so that
+	// concurrent workers can't overshoot the budget.
+	mu sync.Mutex
+
+	overQueryLimit atomic.Int64
+	ratesMu        sync.Mutex
+	rates          rateStats
+}
+
+// rateStats records how the adaptive rate limiter treated a job. It is
+// stored as JSON in the rate_stats column.
+type rateStats struct {
+	OverQueryLimit int64 `json:"over_query_limit"`
+	// MinQPS is the lowest rate allowed to each endpoint while the job ran
+	// and QPS the rate when it stopped.
+	MinQPS googlemaps.Rates `json:"min_qps,omitempty"`
+	QPS    googlemaps.Rates `json:"qps,omitempty"`
+}
+
+// merge adds the stats of another run of the same job, e.g. a chunk.
+func (s *rateStats) merge(o rateStats) {
+	s.OverQueryLimit += o.OverQueryLimit
+	for endpoint, qps := range o.MinQPS {
+		if s.MinQPS == nil {
+			s.MinQPS = googlemaps.Rates{}
+		}
+		if cur, ok := s.MinQPS[endpoint]; !ok || qps < cur {
+			s.MinQPS[endpoint] = qps
+		}
+	}
+	if o.QPS != nil {
+		s.QPS = o.QPS
+	}
+}
+
+func (s rateStats) Value() (driver.Value, error) {
+	b, err := json.Marshal(s)
+	return string(b), err
+}
+
+func (s *rateStats) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*s = rateStats{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, s)
+	case string:
+		return json.Unmarshal([]byte(v), s)
+	}
+	return fmt.Errorf("cannot scan %T into rate stats", src)
+}
+
+// sampleRates records the rates currently allowed by the client's limiter.
+func (m *meteredMaps) sampleRates() {
+	current := m.client.CurrentRates()
+	if current == nil {
+		return
+	}
+	m.ratesMu.Lock()
+	defer m.ratesMu.Unlock()
+	m.rates.merge(rateStats{MinQPS: current, QPS: current})
+}
+
+// rateStats returns the rate stats of the run so far.
+func (m *meteredMaps) rateStats() rateStats {
+	m.sampleRates()
+	m.ratesMu.Lock()
+	defer m.ratesMu.Unlock()
+	stats := m.rates
+	stats.OverQueryLimit = m.overQueryLimit.Load()
+	return stats
+}
+
+// observe counts the calls refused with OVER_QUERY_LIMIT, after which the
+// rate was most likely lowered.
+func (m *meteredMaps) observe(err error) {
+	if googlemaps.IsOverQueryLimit(err) {
+		m.overQueryLimit.Add(1)
+		m.sampleRates()
+	}
+}
+
+func (m *meteredMaps) reserve(endpoint googlemaps.Endpoint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.budget != nil {
+		if err := m.budget.allow(m.usage.Counts(), endpoint); err != nil {
+			return err
+		}
+	}
+	m.usage.Add(endpoint)
+	return nil
+}
+
+func (m *meteredMaps) Geocode(ctx context.Context, address string) (*googlemaps.GeocodeResponse, error) {
+	if err := m.reserve(googlemaps.EndpointGeocode); err != nil {
+		return nil, err
+	}
+	resp, err := m.client.Geocode(ctx, address)
+	m.observe(err)
+	return resp, err
+}
+
+func (m *meteredMaps) NearbySearch(ctx context.Context, lat, lng float64, radius uint) (*googlemaps.NearbySearchResponse, error) {
+	if err := m.reserve(googlemaps.EndpointNearbySearch); err != nil {
+		return nil, err
+	}
+	resp, err := m.client.NearbySearch(ctx, lat, lng, radius)
+	m.observe(err)
+	return resp, err
+}
+
+func (m *meteredMaps) GetPlaceDetails(ctx context.Context, placeID string) (*googlemaps.PlaceDetailsResult, error) {
+	if err := m.reserve(googlemaps.EndpointPlaceDetails); err != nil {
+		return nil, err
+	}
+	resp, err := m.client.GetPlaceDetails(ctx, placeID)
+	m.observe(err)
+	return resp, err
+}
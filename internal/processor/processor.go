@@ -2,84 +2,407 @@ package processor
 
 import (
 	"context"
+	"database/sql"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	"github.com/minio/minio-go/v7"
 
+	"processador-de-enderecos/internal/cache"
+	"processador-de-enderecos/internal/decompress"
+	"processador-de-enderecos/internal/jobs"
+	"processador-de-enderecos/internal/messages"
+	"processador-de-enderecos/internal/outbox"
+	"processador-de-enderecos/internal/output"
+	"processador-de-enderecos/internal/storage"
 	"processador-de-enderecos/pkg/googlemaps"
 )
 
 // JobProcessor holds the dependencies for processing a job.
 type JobProcessor struct {
 	db         *sqlx.DB
-	storage    *minio.Client
+	repo       *jobs.Repository
+	uploads    storage.Store
+	results    storage.Store
 	mapsClient *googlemaps.Client
-	logger     *slog.Logger
+	placeCache *cache.PlaceCache
+	prices     googlemaps.PriceTable
+	matcher    *Matcher
+	// monthlyLimits caps the Google usage of each API key.
+	monthlyLimits MonthlyLimits
+	// maxInputBytes caps the decompressed size of an input file.
+	maxInputBytes int64
+	// chunkRows is the number of rows per chunk of the jobs split across
+	// workers; 0 disables splitting. relay publishes the chunk messages.
+	chunkRows int
+	relay     *outbox.Relay
+	logger    *slog.Logger
 }
 
 // NewJobProcessor creates a new JobProcessor.
-func NewJobProcessor(db *sqlx.DB, storage *minio.Client, mapsClient *googlemaps.Client, logger *slog.Logger) *JobProcessor {
+func NewJobProcessor(db *sqlx.DB, repo *jobs.Repository, uploads, results storage.Store, mapsClient *googlemaps.Client, placeCache *cache.PlaceCache, prices googlemaps.PriceTable, monthlyLimits MonthlyLimits, maxInputBytes int64, chunkRows int, relay *outbox.Relay, logger *slog.Logger) *JobProcessor {
 	return &JobProcessor{
-		db:         db,
-		storage:    storage,
-		mapsClient: mapsClient,
-		logger:     logger,
+		db:            db,
+		repo:          repo,
+		uploads:       uploads,
+		results:       results,
+		mapsClient:    mapsClient,
+		matcher:       NewMatcher(mapsClient, placeCache, logger),
+		prices:        prices,
+		monthlyLimits: monthlyLimits,
+		maxInputBytes: maxInputBytes,
+		chunkRows:     chunkRows,
+		relay:         relay,
+		logger:        logger,
 	}
 }
 
-// ProcessJob processes a CSV file of addresses.
-func (p *JobProcessor) ProcessJob(ctx context.Context, jobID, csvPath string) {
-	jobLogger := p.logger.With("job_id", jobID)
+// jobRun holds the per-job state shared by the worker pool.
+type jobRun struct {
+	maps          *meteredMaps
+	cacheHits     atomic.Int64
+	rowsProcessed atomic.Int64
+
+	// stopped is closed when the job must stop reading new rows, e.g.
+	// because its budget is exhausted.
+	stopped    chan struct{}
+	stopOnce   sync.Once
+	stopReason error
+}
+
+func (r *jobRun) stop(reason error) {
+	r.stopOnce.Do(func() {
+		r.stopReason = reason
+		close(r.stopped)
+	})
+}
+
+const (
+	// progressInterval is how often a running job flushes its counters to
+	// the DB and sends a heartbeat.
+	progressInterval = 5 * time.Second
+	// jobLeaseTimeout is how long a PROCESSING job can go without a
+	// heartbeat before another worker may reclaim it.
+	jobLeaseTimeout = 6 * progressInterval
+)
+
+// ProcessJob processes the CSV file of addresses of a job. Jobs with more
+// rows than the chunk size are split into chunks instead, which are
+// processed by ProcessChunk on any worker.
+func (p *JobProcessor) ProcessJob(ctx context.Context, msg messages.JobMessage) {
+	jobID := msg.JobID
+	jobLogger := p.messageLogger(msg)
 
-	// Update job status to PROCESSING
-	_, err := p.db.ExecContext(ctx, "UPDATE jobs SET status = $1, updated_at = $2 WHERE id = $3", "PROCESSING", time.Now(), jobID)
+	// Update job status to PROCESSING and take ownership of it. A job
+	// PROCESSING under another worker is watched until that worker finishes
+	// it or stops sending heartbeats, in which case it is reclaimed; deleted,
+	// expired or already processed jobs are skipped.
+	start := func() (jobs.Status, error) {
+		return p.repo.Transition(ctx, jobID, jobs.Processing, jobs.Change{Fields: map[string]any{"worker_id": p.repo.WorkerID()}})
+	}
+	from, err := start()
+	for waiting := false; errors.Is(err, jobs.ErrInvalidTransition) && from == jobs.Processing; {
+		var reclaimed, split bool
+		reclaimed, split, err = p.reclaimJob(ctx, jobID)
+		if reclaimed {
+			jobLogger.Warn("Reclaimed job from another worker")
+		}
+		if err != nil || reclaimed {
+			break
+		}
+		if split {
+			err = jobs.ErrNotOwner
+			break
+		}
+		if !waiting {
+			jobLogger.Info("Job is being processed by another worker, waiting for it to finish or stop sending heartbeats")
+			waiting = true
+		}
+		if err = sleep(ctx, progressInterval); err != nil {
+			break
+		}
+		from, err = start()
+	}
+	if errors.Is(err, jobs.ErrNotFound) || errors.Is(err, jobs.ErrInvalidTransition) || errors.Is(err, jobs.ErrNotOwner) {
+		jobLogger.Warn("Skipping job", "status", from, "error", err)
+		return
+	}
 	if err != nil {
 		jobLogger.Error("Failed to update job status to PROCESSING", "error", err)
 		return
 	}
 
-	resultPath := "results/" + jobID + ".jsonl"
+	// The job is processed under jobCtx, cancelled if it is cancelled or
+	// reclaimed meanwhile; its final status is stored with ctx.
+	jobCtx, stopHeartbeat := p.heartbeat(ctx, func(ctx context.Context) error { return p.repo.Heartbeat(ctx, jobID) }, jobLogger)
+	defer stopHeartbeat()
 
-	// MinIO read stream
-	object, err := p.storage.GetObject(ctx, "uploads", csvPath, minio.GetObjectOptions{})
+	split, header, err := p.shouldSplit(jobCtx, jobID)
 	if err != nil {
-		jobLogger.Error("Failed to get object from MinIO", "bucket", "uploads", "path", csvPath, "error", err)
-		p.updateJobStatusToFailed(ctx, jobID, err)
+		jobLogger.Error("Failed to read job size", "error", err)
+		p.updateJobStatusToFailed(ctx, jobID, p.repo.WorkerID(), err)
+		return
+	}
+	if split {
+		if err := p.splitJob(jobCtx, msg, header, jobLogger); err != nil {
+			jobLogger.Error("Failed to split job into chunks", "error", err)
+			p.updateJobStatusToFailed(ctx, jobID, p.repo.WorkerID(), err)
+		}
 		return
 	}
-	defer object.Close()
 
-	// MinIO write stream
-	pipeReader, pipeWriter := io.Pipe()
+	jobBudget, err := p.loadBudget(jobCtx, jobID, -1)
+	if err != nil {
+		jobLogger.Error("Failed to load job budget", "error", err)
+		p.updateJobStatusToFailed(ctx, jobID, p.repo.WorkerID(), err)
+		return
+	}
 
-	var wgUpload sync.WaitGroup
-	wgUpload.Add(1)
+	retry, err := p.loadRetry(jobCtx, jobID)
+	if err != nil {
+		jobLogger.Error("Failed to load retry parent", "error", err)
+		p.updateJobStatusToFailed(ctx, jobID, p.repo.WorkerID(), err)
+		return
+	}
+
+	input, err := p.openInput(jobCtx, msg.InputPath, msg.Format, jobLogger)
+	if err != nil {
+		p.updateJobStatusToFailed(ctx, jobID, p.repo.WorkerID(), err)
+		return
+	}
+	defer input.Close()
+
+	resultPath := "results/" + jobID + ".jsonl"
+	res := p.processRows(jobCtx, rowsRun{
+		jobID:      jobID,
+		input:      input,
+		header:     header,
+		firstRow:   1,
+		retry:      retry,
+		budget:     jobBudget,
+		resultPath: resultPath,
+		flush: func(run *jobRun) {
+			p.flushProgress(jobCtx, jobID, run)
+		},
+		logger: jobLogger,
+	})
+	stopHeartbeat()
+	p.completeJob(ctx, jobID, retry, res.outcome(resultPath), p.repo.WorkerID(), jobLogger)
+}
+
+// reclaimJob takes over a job left PROCESSING by another worker that stopped
+// sending heartbeats. A redelivered message alone does not prove the owner
+// died: the broker also redelivers after a channel closes or a consumer
+// times out, while the owner is still working. Jobs already split into
+// chunks are left to them; split reports those.
+func (p *JobProcessor) reclaimJob(ctx context.Context, jobID string) (reclaimed, split bool, err error) {
+	err = p.repo.InTx(ctx, func(tx *jobs.Tx) error {
+		// Lock the job first, so a split committed meanwhile is seen.
+		if _, err := tx.ExecContext(ctx, "SELECT id FROM jobs WHERE id = $1 FOR UPDATE", jobID); err != nil {
+			return err
+		}
+		if err := tx.GetContext(ctx, &split, "SELECT EXISTS (SELECT 1 FROM job_chunks WHERE job_id = $1)", jobID); err != nil || split {
+			return err
+		}
+		var err error
+		reclaimed, err = tx.Reclaim(ctx, jobID, jobLeaseTimeout, "heartbeat expired")
+		return err
+	})
+	return reclaimed, split, err
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// heartbeat calls beat every progressInterval until stopped. The returned
+// context is cancelled once beat returns jobs.ErrNotOwner, i.e. the job or
+// chunk is no longer PROCESSING and owned by this worker, e.g. because it
+// was cancelled or reclaimed, so the worker stops spending calls on it.
+func (p *JobProcessor) heartbeat(ctx context.Context, beat func(context.Context) error, logger *slog.Logger) (context.Context, func()) {
+	jobCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
 	go func() {
-		defer wgUpload.Done()
-		_, err := p.storage.PutObject(ctx, "results", resultPath, pipeReader, -1, minio.PutObjectOptions{ContentType: "application/jsonl"})
-		if err != nil {
-			jobLogger.Error("Failed to upload result file to MinIO", "bucket", "results", "path", resultPath, "error", err)
-			// We can't reliably update the job status here as the main function might have already exited
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := beat(ctx)
+				if errors.Is(err, jobs.ErrNotOwner) {
+					logger.Warn("No longer owned by this worker, stopping")
+					cancel()
+					return
+				}
+				if err != nil {
+					logger.Warn("Failed to send heartbeat", "error", err)
+				}
+			}
 		}
 	}()
+	var once sync.Once
+	return jobCtx, func() {
+		once.Do(func() {
+			close(done)
+			cancel()
+		})
+	}
+}
 
-	csvReader := csv.NewReader(object)
+// messageLogger returns the logger of the job of msg, annotated with its
+// tenant, label and parent job, and with the trace context of the request
+// that submitted it.
+func (p *JobProcessor) messageLogger(msg messages.JobMessage) *slog.Logger {
+	attrs := []any{"job_id", msg.JobID}
+	if msg.Tenant != "" {
+		attrs = append(attrs, "tenant", msg.Tenant)
+	}
+	if msg.Options.Label != "" {
+		attrs = append(attrs, "label", msg.Options.Label)
+	}
+	if msg.Options.ParentJobID != "" {
+		attrs = append(attrs, "parent_job_id", msg.Options.ParentJobID)
+	}
+	if msg.Trace != nil {
+		attrs = append(attrs, "traceparent", msg.Trace.Parent)
+		if msg.Trace.State != "" {
+			attrs = append(attrs, "tracestate", msg.Trace.State)
+		}
+	}
+	return p.logger.With(attrs...)
+}
+
+// openInput opens an input file of the uploads store. Compressed inputs are
+// detected by their magic bytes and decompressed while streaming. If want is
+// set, an input in another format, e.g. replaced after it was validated, is
+// refused.
+func (p *JobProcessor) openInput(ctx context.Context, path string, want decompress.Format, logger *slog.Logger) (io.ReadCloser, error) {
+	object, err := p.uploads.Get(ctx, path)
+	if err != nil {
+		logger.Error("Failed to get input file", "path", path, "error", err)
+		return nil, err
+	}
+	input, format, err := decompress.NewReader(object, object.Info().Size, p.maxInputBytes)
+	if err == nil && want != "" && format != want {
+		input.Close()
+		err = fmt.Errorf("input file is %s, expected %s", format, want)
+	}
+	if err != nil {
+		object.Close()
+		logger.Error("Failed to open input file", "path", path, "format", format, "error", err)
+		return nil, err
+	}
+	return inputReader{ReadCloser: input, object: object}, nil
+}
+
+// inputReader closes the decompressor and the object it reads from.
+type inputReader struct {
+	io.ReadCloser
+	object io.Closer
+}
+
+func (r inputReader) Close() error {
+	err := r.ReadCloser.Close()
+	if objErr := r.object.Close(); err == nil {
+		err = objErr
+	}
+	return err
+}
+
+// rowsRun describes the rows processed by one call to processRows: a whole
+// job or one of its chunks.
+type rowsRun struct {
+	jobID string
+	input io.Reader
+	// header is set when the first line of input is a header row.
+	header bool
+	// firstRow is the number of the first row of input in the job's input.
+	firstRow   int
+	retry      *retryInfo
+	budget     *budget
+	resultPath string
+	// flush stores the progress of the run.
+	flush  func(run *jobRun)
+	logger *slog.Logger
+}
+
+// rowsResult is the outcome of processRows.
+type rowsResult struct {
+	run       *jobRun
+	prices    googlemaps.PriceTable
+	readErr   error
+	uploadErr error
+}
+
+// processRows matches the rows of a CSV input with the worker pool, streams
+// the results to resultPath in the results store and stores them in
+// job_results.
+func (p *JobProcessor) processRows(ctx context.Context, rr rowsRun) *rowsResult {
+	logger := rr.logger
+
+	// Result write stream. A failed upload cancels the job, so it stops
+	// spending API calls on results that cannot be stored.
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var uploadErr error
+	upload := startResultUpload(ctx, p.results, rr.resultPath, "application/jsonl", func(err error) {
+		logger.Error("Failed to upload result file", "path", rr.resultPath, "error", err)
+		cancel()
+	})
+
+	csvReader := csv.NewReader(rr.input)
+	run := &jobRun{
+		maps:    &meteredMaps{client: p.mapsClient, usage: &googlemaps.Usage{}, budget: rr.budget},
+		stopped: make(chan struct{}),
+	}
+
+	// Progress flusher goroutine
+	progressDone := make(chan struct{})
+	var wgProgress sync.WaitGroup
+	wgProgress.Add(1)
+	go func() {
+		defer wgProgress.Done()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-progressDone:
+				return
+			case <-ticker.C:
+				rr.flush(run)
+				if err := rr.budget.refresh(ctx, p.db); err != nil {
+					logger.Warn("Failed to refresh API key usage", "error", err)
+				}
+			}
+		}
+	}()
 
 	// Worker pool
 	numWorkers := 50
-	tasks := make(chan string)
-	results := make(chan map[string]interface{})
+	tasks := make(chan task)
+	results := make(chan output.Record)
 
 	var wgWorkers sync.WaitGroup
 	for i := 0; i < numWorkers; i++ {
 		wgWorkers.Add(1)
-		go p.worker(ctx, &wgWorkers, tasks, results)
+		go p.worker(jobCtx, run, &wgWorkers, tasks, results)
 	}
 
 	// Result writer goroutine
@@ -87,124 +410,193 @@ func (p *JobProcessor) ProcessJob(ctx context.Context, jobID, csvPath string) {
 	wgResultWriter.Add(1)
 	go func() {
 		defer wgResultWriter.Done()
-		jsonlWriter := json.NewEncoder(pipeWriter)
+		jsonlWriter := json.NewEncoder(upload)
+		rows := newRowStore(p.db, rr.jobID)
+		var writeErr error
 		for result := range results {
-			if err := jsonlWriter.Encode(result); err != nil {
-				jobLogger.Warn("Failed to write result to JSONL stream", "error", err)
+			// Writes only fail once the upload has failed, which already
+			// cancelled the job; the remaining results are still drained.
+			if writeErr == nil {
+				writeErr = jsonlWriter.Encode(result)
+			}
+			if err := rows.add(ctx, result); err != nil {
+				logger.Warn("Failed to store result rows", "error", err)
 			}
+			run.rowsProcessed.Add(1)
 		}
-		pipeWriter.Close()
+		if err := rows.flush(ctx); err != nil {
+			logger.Warn("Failed to store result rows", "error", err)
+		}
+		uploadErr = upload.Close(ctx)
 	}()
 
 	// CSV reader goroutine
+	var readErr error
 	go func() {
-		// Skip header
-		_, _ = csvReader.Read()
-		for {
+		defer close(tasks)
+		if rr.header {
+			_, _ = csvReader.Read()
+		}
+		for row := rr.firstRow; ; row++ {
 			record, err := csvReader.Read()
 			if err == io.EOF {
-				break
+				return
 			}
 			if err != nil {
-				jobLogger.Error("Error reading CSV file", "error", err)
-				break
+				logger.Error("Error reading CSV file", "error", err)
+				readErr = err
+				return
+			}
+			select {
+			case tasks <- task{row: rr.retry.parentRow(row), record: record}:
+			case <-run.stopped:
+				return
+			case <-jobCtx.Done():
+				return
 			}
-			tasks <- record[0]
 		}
-		close(tasks)
 	}()
 
 	wgWorkers.Wait()
 	close(results)
 	wgResultWriter.Wait()
-	wgUpload.Wait()
+	close(progressDone)
+	wgProgress.Wait()
 
-	// Update job status to COMPLETED
-	_, err = p.db.ExecContext(ctx, "UPDATE jobs SET status = $1, result_path = $2, updated_at = $3 WHERE id = $4", "COMPLETED", resultPath, time.Now(), jobID)
-	if err != nil {
-		jobLogger.Error("Failed to update job status to COMPLETED", "error", err)
-	} else {
-		jobLogger.Info("Job completed successfully")
+	return &rowsResult{run: run, prices: p.prices, readErr: readErr, uploadErr: uploadErr}
+}
+
+// jobOutcome is the final state of a job or chunk.
+type jobOutcome struct {
+	status        jobs.Status
+	errorMessage  sql.NullString
+	resultPath    sql.NullString
+	rowsProcessed int64
+	calls         googlemaps.CallCounts
+	cacheHits     int64
+	cost          float64
+	rates         rateStats
+}
+
+// outcome returns the final state of the rows written to resultPath.
+//
+// When reading fails or the budget runs out, the rows processed so far are
+// still uploaded as partial results. A result that could not be stored or
+// verified is not offered for download.
+func (r *rowsResult) outcome(resultPath string) jobOutcome {
+	o := jobOutcome{
+		status:        jobs.Completed,
+		resultPath:    sql.NullString{String: resultPath, Valid: true},
+		rowsProcessed: r.run.rowsProcessed.Load(),
+		calls:         r.run.maps.usage.Counts(),
+		cacheHits:     r.run.cacheHits.Load(),
+		rates:         r.run.maps.rateStats(),
 	}
+	o.cost = r.prices.Cost(o.calls)
+	if r.uploadErr != nil {
+		o.status = jobs.Failed
+		o.errorMessage = sql.NullString{String: r.uploadErr.Error(), Valid: true}
+		o.resultPath = sql.NullString{}
+	} else if r.readErr != nil {
+		o.status = jobs.Failed
+		o.errorMessage = sql.NullString{String: "reading input: " + r.readErr.Error(), Valid: true}
+	} else if r.run.stopReason != nil {
+		o.status = jobs.BudgetExceeded
+		o.errorMessage = sql.NullString{String: r.run.stopReason.Error(), Valid: true}
+	}
+	return o
 }
 
-func (p *JobProcessor) worker(ctx context.Context, wg *sync.WaitGroup, tasks <-chan string, results chan<- map[string]interface{}) {
-	defer wg.Done()
-	for address := range tasks {
-		// Step 1: Geocode the address to get coordinates and a fallback place_id
-		geocodeResponse, err := p.mapsClient.Geocode(ctx, address)
+// completeJob merges the result of retry jobs into their parent's and moves
+// the job to its final status, provided owner, if set, still owns it.
+func (p *JobProcessor) completeJob(ctx context.Context, jobID string, retry *retryInfo, o jobOutcome, owner string, jobLogger *slog.Logger) {
+	// Retry jobs also offer the parent result with the retried rows replaced.
+	var mergedPath sql.NullString
+	if o.resultPath.Valid && retry.ParentJobID.Valid && retry.BaseResultPath.Valid {
+		path, err := p.mergeResults(ctx, jobID, retry.BaseResultPath.String, o.resultPath.String)
 		if err != nil {
-			p.logger.Warn("Failed to geocode address", "address", address, "error", err)
-			results <- map[string]interface{}{"address": address, "error": err.Error()}
-			continue
+			jobLogger.Error("Failed to merge retried rows into parent result", "parent_job_id", retry.ParentJobID.String, "error", err)
+		} else {
+			mergedPath = sql.NullString{String: path, Valid: true}
 		}
+	}
 
-		if geocodeResponse.Status == "ZERO_RESULTS" || len(geocodeResponse.Results) == 0 {
-			results <- map[string]interface{}{"address": address, "status": "NO_RESULTS_FOUND"}
-			continue
-		}
+	_, err := p.repo.Transition(ctx, jobID, o.status, jobs.Change{
+		Fields: map[string]any{
+			"result_path":         o.resultPath,
+			"merged_result_path":  mergedPath,
+			"error_message":       o.errorMessage,
+			"rows_processed":      o.rowsProcessed,
+			"geocode_calls":       o.calls.Geocode,
+			"nearby_search_calls": o.calls.NearbySearch,
+			"place_details_calls": o.calls.PlaceDetails,
+			"cache_hits":          o.cacheHits,
+			"cost_usd":            o.cost,
+			"rate_stats":          o.rates,
+		},
+		Message: o.errorMessage.String,
+		Owner:   owner,
+	})
+	switch {
+	case errors.Is(err, jobs.ErrNotOwner) || errors.Is(err, jobs.ErrInvalidTransition):
+		jobLogger.Warn("Dropping job outcome", "status", o.status, "error", err)
+	case err != nil:
+		jobLogger.Error("Failed to update job status to "+string(o.status), "error", err)
+	case o.status == jobs.Failed:
+		jobLogger.Error("Job failed", "error", o.errorMessage.String, "rows_processed", o.rowsProcessed)
+	case o.status == jobs.BudgetExceeded:
+		jobLogger.Warn("Job stopped by budget", "reason", o.errorMessage.String, "rows_processed", o.rowsProcessed, "cost_usd", o.cost)
+	default:
+		jobLogger.Info("Job completed successfully", "api_calls", o.calls.Total(), "cache_hits", o.cacheHits, "cost_usd", o.cost)
+	}
+}
 
-		// Use the first result for coordinates and as a fallback
-		firstResult := geocodeResponse.Results[0]
-		lat := firstResult.Geometry.Location.Lat
-		lng := firstResult.Geometry.Location.Lng
-		fallbackPlaceID := firstResult.PlaceID
+// flushProgress stores the counters of a running job so that progress and
+// month-to-date spend are visible while it runs.
+func (p *JobProcessor) flushProgress(ctx context.Context, jobID string, run *jobRun) {
+	calls := run.maps.usage.Counts()
+	_, err := p.db.ExecContext(ctx, `UPDATE jobs SET rows_processed = $1, geocode_calls = $2, nearby_search_calls = $3, place_details_calls = $4, cache_hits = $5, cost_usd = $6, rate_stats = $7, updated_at = $8
+		WHERE id = $9 AND worker_id = $10`,
+		run.rowsProcessed.Load(), calls.Geocode, calls.NearbySearch, calls.PlaceDetails, run.cacheHits.Load(), p.prices.Cost(calls), run.maps.rateStats(), time.Now(), jobID, p.repo.WorkerID())
+	if err != nil {
+		p.logger.Warn("Failed to flush job progress", "job_id", jobID, "error", err)
+	}
+}
 
-		// Step 2: Perform a Nearby Search for establishments
-		nearbyResponse, err := p.mapsClient.NearbySearch(ctx, lat, lng, 25) // 25-meter radius
+// task is one input row handed to the worker pool.
+type task struct {
+	row    int
+	record []string
+}
+
+func (p *JobProcessor) worker(ctx context.Context, run *jobRun, wg *sync.WaitGroup, tasks <-chan task, results chan<- output.Record) {
+	defer wg.Done()
+	for t := range tasks {
+		address := t.record[0]
+		result, cached, err := p.matcher.match(ctx, run.maps, address)
 		if err != nil {
-			p.logger.Warn("Nearby Search failed", "address", address, "lat", lat, "lng", lng, "error", err)
-			results <- map[string]interface{}{"address": address, "place_id": fallbackPlaceID, "status": "NEARBY_SEARCH_FAILED"}
-			continue
-		}
-
-		var establishmentPlaceID string
-		if nearbyResponse.Status == "OK" && len(nearbyResponse.Results) > 0 {
-			// Find the first result that is explicitly a business
-			for _, place := range nearbyResponse.Results {
-				isBusiness := false
-				for _, t := range place.Types {
-					// Check for common business-related types.
-					if t == "establishment" || t == "point_of_interest" || t == "store" || t == "supermarket" || t == "restaurant" {
-						isBusiness = true
-						break
-					}
-				}
-				if isBusiness {
-					establishmentPlaceID = place.PlaceID
-					break // Found a good candidate, stop searching
-				}
-			}
+			run.stop(err)
 		}
-
-		// Step 3: Get details if an establishment was found
-		if establishmentPlaceID != "" {
-			detailsResult, err := p.mapsClient.GetPlaceDetails(ctx, establishmentPlaceID)
-			if err != nil {
-				p.logger.Warn("Failed to get place details for establishment", "address", address, "place_id", establishmentPlaceID, "error", err)
-				results <- map[string]interface{}{"address": address, "place_id": establishmentPlaceID, "status": "GET_DETAILS_FAILED"}
-				continue
-			}
-			results <- map[string]interface{}{
-				"address":  address,
-				"place_id": establishmentPlaceID,
-				"details":  detailsResult,
-			}
-		} else {
-			// If no establishment was found nearby, output the fallback
-			results <- map[string]interface{}{
-				"address":  address,
-				"place_id": fallbackPlaceID,
-				"details":  nil,
-				"status":   "NO_ESTABLISHMENT_FOUND",
-			}
+		if cached {
+			run.cacheHits.Add(1)
 		}
+
+		result.Row = t.row
+		result.Input = t.record
+		result.Address = address
+		results <- result
 	}
 }
 
-func (p *JobProcessor) updateJobStatusToFailed(ctx context.Context, jobID string, err error) {
+// updateJobStatusToFailed moves a job to FAILED, provided owner, if set,
+// still owns it.
+func (p *JobProcessor) updateJobStatusToFailed(ctx context.Context, jobID, owner string, err error) {
 	jobLogger := p.logger.With("job_id", jobID)
-	_, updateErr := p.db.ExecContext(ctx, "UPDATE jobs SET status = $1, error_message = $2, updated_at = $3 WHERE id = $4", "FAILED", err.Error(), time.Now(), jobID)
+	_, updateErr := p.repo.Transition(ctx, jobID, jobs.Failed, jobs.Change{Fields: map[string]any{"error_message": err.Error()}, Message: err.Error(), Owner: owner})
+	if errors.Is(updateErr, jobs.ErrNotOwner) || errors.Is(updateErr, jobs.ErrInvalidTransition) {
+		jobLogger.Warn("Not marking job FAILED", "original_error", err, "update_error", updateErr)
+		return
+	}
 	if updateErr != nil {
 		jobLogger.Error("Failed to update job status to FAILED", "original_error", err, "update_error", updateErr)
 	}
@@ -0,0 +1,145 @@
+package processor
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/lib/pq"
+)
+
+// retryInfo links a retry job to the job whose rows it re-runs.
+type retryInfo struct {
+	ParentJobID sql.NullString `db:"parent_job_id"`
+	// Rows maps the rows of the retry input, in order, to the parent rows.
+	Rows pq.Int64Array `db:"retry_rows"`
+	// BaseResultPath is the parent result the retried rows are merged into.
+	BaseResultPath sql.NullString `db:"base_result_path"`
+}
+
+// loadRetry reads the parent of a job. Jobs that are not retries get an
+// empty retryInfo.
+func (p *JobProcessor) loadRetry(ctx context.Context, jobID string) (*retryInfo, error) {
+	var info retryInfo
+	err := p.db.GetContext(ctx, &info, `SELECT j.parent_job_id, j.retry_rows, COALESCE(parent.merged_result_path, parent.result_path) AS base_result_path
+		FROM jobs j LEFT JOIN jobs parent ON parent.id = j.parent_job_id WHERE j.id = $1`, jobID)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// parentRow returns the row number of the parent job for a row of the retry
+// input, so that results line up with the original upload.
+func (r *retryInfo) parentRow(row int) int {
+	if row < 1 || row > len(r.Rows) {
+		return row
+	}
+	return int(r.Rows[row-1])
+}
+
+// mergeResults writes a copy of the base result in which the rows of the
+// retry result replace the original ones, and returns its path.
+func (p *JobProcessor) mergeResults(ctx context.Context, jobID, basePath, retryPath string) (string, error) {
+	retried, err := p.readResultRows(ctx, retryPath)
+	if err != nil {
+		return "", fmt.Errorf("reading retry result: %w", err)
+	}
+
+	base, err := p.results.Get(ctx, basePath)
+	if err != nil {
+		return "", fmt.Errorf("reading base result: %w", err)
+	}
+	defer base.Close()
+
+	mergedPath := "results/" + jobID + ".merged.jsonl"
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		pipeWriter.CloseWithError(mergeLines(base, pipeWriter, retried))
+	}()
+	_, err = p.results.Put(ctx, mergedPath, pipeReader, -1, "application/jsonl")
+	if err != nil {
+		pipeReader.CloseWithError(err)
+		return "", err
+	}
+	return mergedPath, nil
+}
+
+// readResultRows loads the lines of a result file by row number. It is only
+// used for retry results, which hold the few rows that failed.
+func (p *JobProcessor) readResultRows(ctx context.Context, path string) (map[int][]byte, error) {
+	object, err := p.results.Get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	rows := make(map[int][]byte)
+	err = eachLine(object, func(row int, line []byte) error {
+		rows[row] = line
+		return nil
+	})
+	return rows, err
+}
+
+// mergeLines copies the lines of base to w, replacing the rows found in
+// retried. Retried rows missing from base are appended in row order.
+func mergeLines(base io.Reader, w io.Writer, retried map[int][]byte) error {
+	bw := bufio.NewWriter(w)
+	err := eachLine(base, func(row int, line []byte) error {
+		if replacement, ok := retried[row]; ok {
+			line = replacement
+			delete(retried, row)
+		}
+		_, err := bw.Write(line)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	rest := make([]int, 0, len(retried))
+	for row := range retried {
+		rest = append(rest, row)
+	}
+	sort.Ints(rest)
+	for _, row := range rest {
+		if _, err := bw.Write(retried[row]); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// eachLine calls fn with every line of a JSONL result, including its
+// trailing newline, and the row number it holds.
+func eachLine(r io.Reader, fn func(row int, line []byte) error) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			var rec struct {
+				Row int `json:"row"`
+			}
+			if jsonErr := json.Unmarshal(line, &rec); jsonErr != nil {
+				return jsonErr
+			}
+			if line[len(line)-1] != '\n' {
+				line = append(line, '\n')
+			}
+			if fnErr := fn(rec.Row, line); fnErr != nil {
+				return fnErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package processor
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	"processador-de-enderecos/internal/output"
+)
+
+// rowBatchSize is the number of result rows written per INSERT.
+const rowBatchSize = 500
+
+// jobResultRow is a row of the job_results table.
+type jobResultRow struct {
+	JobID            string          `db:"job_id"`
+	RowNumber        int             `db:"row_number"`
+	Input            pq.StringArray  `db:"input"`
+	Address          string          `db:"address"`
+	Status           string          `db:"status"`
+	PlaceID          sql.NullString  `db:"place_id"`
+	Name             sql.NullString  `db:"name"`
+	FormattedAddress sql.NullString  `db:"formatted_address"`
+	Phone            sql.NullString  `db:"phone"`
+	Website          sql.NullString  `db:"website"`
+	Lat              sql.NullFloat64 `db:"lat"`
+	Lng              sql.NullFloat64 `db:"lng"`
+	Score            sql.NullFloat64 `db:"score"`
+	Error            sql.NullString  `db:"error"`
+	CreatedAt        time.Time       `db:"created_at"`
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// rowStore buffers result rows and writes them to job_results in batches, so
+// that results can be browsed without downloading the JSONL file.
+type rowStore struct {
+	db    *sqlx.DB
+	jobID string
+	buf   []jobResultRow
+}
+
+func newRowStore(db *sqlx.DB, jobID string) *rowStore {
+	return &rowStore{db: db, jobID: jobID, buf: make([]jobResultRow, 0, rowBatchSize)}
+}
+
+// add buffers a result and flushes the buffer once it is full.
+func (s *rowStore) add(ctx context.Context, rec output.Record) error {
+	place := rec.Place()
+	row := jobResultRow{
+		JobID:            s.jobID,
+		RowNumber:        rec.Row,
+		Input:            rec.Input,
+		Address:          rec.Address,
+		Status:           rec.EffectiveStatus(),
+		PlaceID:          nullString(rec.PlaceID),
+		Name:             nullString(place.Name),
+		FormattedAddress: nullString(place.FormattedAddress),
+		Phone:            nullString(place.Phone),
+		Website:          nullString(place.Website),
+		Error:            nullString(rec.Error),
+		CreatedAt:        time.Now(),
+	}
+	if rec.Location != nil {
+		row.Lat = sql.NullFloat64{Float64: rec.Location.Lat, Valid: true}
+		row.Lng = sql.NullFloat64{Float64: rec.Location.Lng, Valid: true}
+	}
+	if rec.Score != nil {
+		row.Score = sql.NullFloat64{Float64: *rec.Score, Valid: true}
+	}
+
+	s.buf = append(s.buf, row)
+	if len(s.buf) >= rowBatchSize {
+		return s.flush(ctx)
+	}
+	return nil
+}
+
+// flush writes the buffered rows. Rows already stored by a previous run of
+// the same job are replaced.
+func (s *rowStore) flush(ctx context.Context) error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	_, err := s.db.NamedExecContext(ctx, `INSERT INTO job_results (job_id, row_number, input, address, status, place_id, name, formatted_address, phone, website, lat, lng, score, error, created_at)
+		VALUES (:job_id, :row_number, :input, :address, :status, :place_id, :name, :formatted_address, :phone, :website, :lat, :lng, :score, :error, :created_at)
+		ON CONFLICT (job_id, row_number) DO UPDATE SET input = EXCLUDED.input, address = EXCLUDED.address, status = EXCLUDED.status, place_id = EXCLUDED.place_id,
+			name = EXCLUDED.name, formatted_address = EXCLUDED.formatted_address, phone = EXCLUDED.phone, website = EXCLUDED.website,
+			lat = EXCLUDED.lat, lng = EXCLUDED.lng, score = EXCLUDED.score, error = EXCLUDED.error, created_at = EXCLUDED.created_at`, s.buf)
+	s.buf = s.buf[:0]
+	return err
+}
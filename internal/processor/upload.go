@@ -0,0 +1,111 @@
+package processor
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"processador-de-enderecos/internal/storage"
+)
+
+// resultUpload streams a result file to storage while it is written, keeping
+// the size and MD5s of what was written to verify the stored object.
+type resultUpload struct {
+	store   storage.Store
+	key     string
+	pw      *io.PipeWriter
+	written int64
+	// md5 hashes the whole file and part the current storage.PartSize
+	// bytes; parts holds the MD5s of the parts already written.
+	md5   hash.Hash
+	part  hash.Hash
+	parts []byte
+
+	done chan struct{}
+	err  error
+}
+
+// startResultUpload starts uploading everything written to the returned
+// upload to key. If the upload fails, the pipe is closed with the error, so
+// further writes fail with it, and onError is called.
+func startResultUpload(ctx context.Context, store storage.Store, key, contentType string, onError func(error)) *resultUpload {
+	pr, pw := io.Pipe()
+	u := &resultUpload{store: store, key: key, pw: pw, md5: md5.New(), part: md5.New(), done: make(chan struct{})}
+	go func() {
+		defer close(u.done)
+		_, u.err = store.Put(ctx, key, pr, -1, contentType)
+		if u.err != nil {
+			pr.CloseWithError(u.err)
+			onError(u.err)
+		}
+	}()
+	return u
+}
+
+func (u *resultUpload) Write(b []byte) (int, error) {
+	n, err := u.pw.Write(b)
+	u.md5.Write(b[:n])
+	for written := b[:n]; len(written) > 0; {
+		room := storage.PartSize - int(u.written%storage.PartSize)
+		chunk := written[:min(room, len(written))]
+		u.part.Write(chunk)
+		u.written += int64(len(chunk))
+		written = written[len(chunk):]
+		if len(chunk) == room {
+			u.parts = u.part.Sum(u.parts)
+			u.part.Reset()
+		}
+	}
+	return n, err
+}
+
+// multipartETag returns the ETag of a multipart upload of what was written in
+// parts of storage.PartSize bytes: the MD5 of the parts' MD5s followed by the
+// number of parts. An empty upload still has one, empty, part.
+func (u *resultUpload) multipartETag() string {
+	parts := u.parts
+	if u.written%storage.PartSize != 0 || u.written == 0 {
+		parts = u.part.Sum(parts)
+	}
+	sum := md5.Sum(parts)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), len(parts)/md5.Size)
+}
+
+// Abort cancels the upload with err, so no object is stored, and waits for
+// it to stop.
+func (u *resultUpload) Abort(err error) {
+	u.pw.CloseWithError(err)
+	<-u.done
+}
+
+// Close finishes the upload and checks that the stored object has the size
+// and checksum of what was written. Stores that do not report an ETag, such
+// as the local one, are only checked for size.
+func (u *resultUpload) Close(ctx context.Context) error {
+	u.pw.Close()
+	<-u.done
+	if u.err != nil {
+		return fmt.Errorf("uploading result: %w", u.err)
+	}
+
+	info, err := u.store.Stat(ctx, u.key)
+	if err != nil {
+		return fmt.Errorf("verifying result: %w", err)
+	}
+	if info.Size != u.written {
+		return fmt.Errorf("verifying result: stored %d bytes, wrote %d", info.Size, u.written)
+	}
+	etag := strings.Trim(info.ETag, `"`)
+	want := hex.EncodeToString(u.md5.Sum(nil))
+	if strings.Contains(etag, "-") {
+		want = u.multipartETag()
+	}
+	if etag != "" && !strings.EqualFold(etag, want) {
+		return fmt.Errorf("verifying result: stored ETag %s, wrote %s", etag, want)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"processador-de-enderecos/internal/storage"
+)
+
+// partStore keeps one object in memory and reports the ETag an S3 store
+// gives it: the MD5 for a single PUT, or the MD5 of the MD5s of its
+// storage.PartSize parts for a multipart upload.
+type partStore struct {
+	data      []byte
+	multipart bool
+	// corrupt flips a byte of the stored object.
+	corrupt bool
+}
+
+func (s *partStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (storage.ObjectInfo, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	if s.corrupt && len(data) > 0 {
+		data[len(data)/2] ^= 0xff
+	}
+	s.data = data
+	return s.info(key), nil
+}
+
+func (s *partStore) info(key string) storage.ObjectInfo {
+	if !s.multipart {
+		sum := md5.Sum(s.data)
+		return storage.ObjectInfo{Key: key, Size: int64(len(s.data)), ETag: `"` + hex.EncodeToString(sum[:]) + `"`}
+	}
+	var sums []byte
+	parts := 0
+	for off := 0; off == 0 || off < len(s.data); off += storage.PartSize {
+		sum := md5.Sum(s.data[off:min(off+storage.PartSize, len(s.data))])
+		sums = append(sums, sum[:]...)
+		parts++
+	}
+	sum := md5.Sum(sums)
+	return storage.ObjectInfo{Key: key, Size: int64(len(s.data)), ETag: fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sum[:]), parts)}
+}
+
+func (s *partStore) Stat(ctx context.Context, key string) (storage.ObjectInfo, error) {
+	return s.info(key), nil
+}
+
+func (s *partStore) Get(ctx context.Context, key string) (storage.Object, error) {
+	return nil, storage.ErrNotFound
+}
+
+func (s *partStore) Delete(ctx context.Context, key string) error { return nil }
+
+func (s *partStore) PresignGet(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	return "", nil
+}
+
+func (s *partStore) PresignPut(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	return "", nil
+}
+
+func TestResultUploadVerifiesETag(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		multipart bool
+		corrupt   bool
+		err       string
+	}{
+		{name: "empty multipart", size: 0, multipart: true},
+		{name: "small multipart", size: 1000, multipart: true},
+		{name: "exactly one part", size: storage.PartSize, multipart: true},
+		{name: "one byte into the second part", size: storage.PartSize + 1, multipart: true},
+		{name: "exactly two parts", size: 2 * storage.PartSize, multipart: true},
+		{name: "single put", size: 1000},
+		{name: "corrupted multipart", size: storage.PartSize + 1, multipart: true, corrupt: true, err: "stored ETag"},
+		{name: "corrupted single put", size: 1000, corrupt: true, err: "stored ETag"},
+	}
+	rng := rand.New(rand.NewSource(1))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := make([]byte, tt.size)
+			rng.Read(data)
+			store := &partStore{multipart: tt.multipart, corrupt: tt.corrupt}
+			u := startResultUpload(context.Background(), store, "results/x.jsonl", "application/jsonl", func(error) {})
+
+			// Write in uneven pieces, so writes straddle part boundaries.
+			r := bytes.NewReader(data)
+			for r.Len() > 0 {
+				piece := make([]byte, 1+rng.Intn(3<<20))
+				n, _ := r.Read(piece)
+				if _, err := u.Write(piece[:n]); err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+			}
+
+			err := u.Close(context.Background())
+			if tt.err == "" && err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("Close() error = %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
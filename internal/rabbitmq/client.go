@@ -0,0 +1,356 @@
+// Package rabbitmq wraps an AMQP connection that recovers from broker
+// restarts and network failures: when the connection closes it reconnects
+// with backoff, declares the topology again and re-registers the consumers.
+// Messages are published in confirm mode. Channels the broker closes alone
+// are opened again.
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// minBackoff and maxBackoff bound the wait between reconnection
+	// attempts, which doubles after each failure.
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+	// PublishTimeout is how long Publish waits for a connection and for the
+	// broker to confirm a message when ctx has no earlier deadline.
+	PublishTimeout = 10 * time.Second
+)
+
+// ErrClosed is returned after Close.
+var ErrClosed = errors.New("rabbitmq client closed")
+
+// Handler processes one delivery. It must ack, nack or reject it.
+type Handler func(d amqp.Delivery)
+
+type consumer struct {
+	queue    string
+	prefetch int
+	handler  Handler
+}
+
+// Client is a reconnecting AMQP connection.
+type Client struct {
+	url      string
+	topology func(ch *amqp.Channel) error
+	logger   *slog.Logger
+
+	mu        sync.Mutex
+	conn      *amqp.Connection
+	consumers []consumer
+	// ready is closed while connected and replaced when the connection
+	// drops, so publishers can wait for the next one.
+	ready  chan struct{}
+	closed bool
+	done   chan struct{}
+
+	// publishMu serializes publishing, so each message waits for its own
+	// confirmation.
+	publishMu sync.Mutex
+	publishCh *amqp.Channel
+	confirms  chan amqp.Confirmation
+	// tag is the delivery tag of the last message published on publishCh.
+	// The broker numbers the messages of a channel in confirm mode from 1.
+	tag uint64
+}
+
+// Dial connects to url and declares the topology, then keeps the connection
+// up until Close. topology is called on every new connection.
+func Dial(url string, topology func(ch *amqp.Channel) error, logger *slog.Logger) (*Client, error) {
+	c := &Client{url: url, topology: topology, logger: logger, ready: make(chan struct{}), done: make(chan struct{})}
+	closes, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	go c.watch(closes)
+	return c, nil
+}
+
+// connect opens the connection and the publishing channel, declares the
+// topology and starts the registered consumers.
+func (c *Client) connect() (chan *amqp.Error, error) {
+	conn, err := amqp.Dial(c.url)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := c.topology(ch); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("declaring topology: %w", err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("enabling publisher confirms: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, cons := range c.consumers {
+		if err := c.startConsumer(conn, cons); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	c.usePublisher(conn, ch)
+	c.conn = conn
+	close(c.ready)
+	return conn.NotifyClose(make(chan *amqp.Error, 1)), nil
+}
+
+// watch reconnects whenever the connection closes.
+func (c *Client) watch(closes chan *amqp.Error) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case err := <-closes:
+			c.mu.Lock()
+			if c.closed {
+				c.mu.Unlock()
+				return
+			}
+			c.ready = make(chan struct{})
+			c.mu.Unlock()
+			c.logger.Warn("RabbitMQ connection lost, reconnecting", "error", err)
+		}
+
+		backoff := minBackoff
+		for {
+			var err error
+			closes, err = c.connect()
+			if err == nil {
+				c.logger.Info("Reconnected to RabbitMQ")
+				break
+			}
+			c.logger.Error("Failed to reconnect to RabbitMQ", "error", err, "retry_in", backoff)
+			select {
+			case <-c.done:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, maxBackoff)
+		}
+	}
+}
+
+// Consume delivers the messages of queue to handler, with at most prefetch
+// unacknowledged deliveries. The consumer is registered again after every
+// reconnection, and on a new channel when the broker closes its channel
+// alone; deliveries not acknowledged before then are redelivered by the
+// broker.
+func (c *Client) Consume(queue string, prefetch int, handler Handler) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cons := consumer{queue: queue, prefetch: prefetch, handler: handler}
+	c.consumers = append(c.consumers, cons)
+	if c.conn == nil || c.conn.IsClosed() {
+		// watch starts it on the next connection.
+		return nil
+	}
+	return c.startConsumer(c.conn, cons)
+}
+
+func (c *Client) startConsumer(conn *amqp.Connection, cons consumer) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	if cons.prefetch > 0 {
+		if err := ch.Qos(cons.prefetch, 0, false); err != nil {
+			ch.Close()
+			return err
+		}
+	}
+	closes := ch.NotifyClose(make(chan *amqp.Error, 1))
+	deliveries, err := ch.Consume(
+		cons.queue, // queue
+		"",         // consumer
+		false,      // auto-ack
+		false,      // exclusive
+		false,      // no-local
+		false,      // no-wait
+		nil,        // args
+	)
+	if err != nil {
+		ch.Close()
+		return fmt.Errorf("consuming %s: %w", cons.queue, err)
+	}
+	// The deliveries channel closes with the channel.
+	go func() {
+		for d := range deliveries {
+			cons.handler(d)
+		}
+		c.restartConsumer(conn, cons, <-closes)
+	}()
+	return nil
+}
+
+// restartConsumer starts a consumer again, with backoff, after the broker
+// closed its channel while the connection stayed up, e.g. because a
+// delivery was acknowledged twice. Consumers of a closed connection are
+// started by watch on the next one.
+func (c *Client) restartConsumer(conn *amqp.Connection, cons consumer, closeErr *amqp.Error) {
+	if !conn.IsClosed() {
+		c.logger.Warn("RabbitMQ consumer channel closed, restarting consumer", "queue", cons.queue, "error", closeErr)
+	}
+	backoff := minBackoff
+	for {
+		c.mu.Lock()
+		if c.closed || c.conn != conn || conn.IsClosed() {
+			c.mu.Unlock()
+			return
+		}
+		err := c.startConsumer(conn, cons)
+		c.mu.Unlock()
+		if err == nil {
+			c.logger.Info("Restarted RabbitMQ consumer", "queue", cons.queue)
+			return
+		}
+		c.logger.Error("Failed to restart RabbitMQ consumer", "queue", cons.queue, "error", err, "retry_in", backoff)
+		select {
+		case <-c.done:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// usePublisher makes ch, in confirm mode, the publishing channel, and opens
+// a new one if the broker closes it while the connection stays up. c.mu must
+// be held.
+func (c *Client) usePublisher(conn *amqp.Connection, ch *amqp.Channel) {
+	closes := ch.NotifyClose(make(chan *amqp.Error, 1))
+	c.publishMu.Lock()
+	c.publishCh = ch
+	c.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	c.tag = 0
+	c.publishMu.Unlock()
+	go func() { c.restartPublisher(conn, <-closes) }()
+}
+
+// restartPublisher opens a new publishing channel, with backoff, after the
+// broker closed it while the connection stayed up, e.g. because a message
+// was published to an exchange that does not exist. Publishing on the
+// closed channel fails until then. The channel of a closed connection is
+// replaced by watch on the next one.
+func (c *Client) restartPublisher(conn *amqp.Connection, closeErr *amqp.Error) {
+	if !conn.IsClosed() {
+		c.logger.Warn("RabbitMQ publishing channel closed, reopening it", "error", closeErr)
+	}
+	backoff := minBackoff
+	for {
+		c.mu.Lock()
+		if c.closed || c.conn != conn || conn.IsClosed() {
+			c.mu.Unlock()
+			return
+		}
+		err := c.startPublisher(conn)
+		c.mu.Unlock()
+		if err == nil {
+			c.logger.Info("Reopened RabbitMQ publishing channel")
+			return
+		}
+		c.logger.Error("Failed to reopen RabbitMQ publishing channel", "error", err, "retry_in", backoff)
+		select {
+		case <-c.done:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+func (c *Client) startPublisher(conn *amqp.Connection) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return fmt.Errorf("enabling publisher confirms: %w", err)
+	}
+	c.usePublisher(conn, ch)
+	return nil
+}
+
+// Publish sends msg to queue through the default exchange and waits for the
+// broker to confirm it. While disconnected it waits for the connection to
+// come back, up to PublishTimeout or ctx's deadline.
+func (c *Client) Publish(ctx context.Context, queue string, msg amqp.Publishing) error {
+	ctx, cancel := context.WithTimeout(ctx, PublishTimeout)
+	defer cancel()
+
+	c.mu.Lock()
+	ready, closed := c.ready, c.closed
+	c.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for RabbitMQ connection: %w", ctx.Err())
+	}
+
+	c.publishMu.Lock()
+	defer c.publishMu.Unlock()
+	err := c.publishCh.Publish(
+		"",    // exchange
+		queue, // routing key
+		false, // mandatory
+		false, // immediate
+		msg)
+	if err != nil {
+		return err
+	}
+	c.tag++
+
+	for {
+		select {
+		case confirm, ok := <-c.confirms:
+			if !ok {
+				return errors.New("channel closed before the message was confirmed")
+			}
+			// Late confirmations of messages that timed out are skipped.
+			if confirm.DeliveryTag < c.tag {
+				continue
+			}
+			if !confirm.Ack {
+				return errors.New("broker rejected the message")
+			}
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for publisher confirm: %w", ctx.Err())
+		}
+	}
+}
+
+// Close closes the connection and stops reconnecting.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
+}
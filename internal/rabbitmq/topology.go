@@ -0,0 +1,45 @@
+package rabbitmq
+
+import "github.com/streadway/amqp"
+
+const (
+	// JobQueue is the queue consumed by the workers. Its messages have a
+	// priority from 0 to MaxPriority.
+	JobQueue = "jobs.tasks"
+	// LegacyJobQueue is the queue used before priorities. A queue's
+	// arguments cannot change once declared, so it is kept and drained by
+	// the workers but no longer published to.
+	LegacyJobQueue = "jobs.queue"
+	// DeadLetterQueue keeps the job messages the workers could not decode,
+	// for inspection. Nothing consumes it.
+	DeadLetterQueue = "jobs.dead"
+
+	// MaxPriority is the highest message priority of JobQueue.
+	MaxPriority = 9
+)
+
+// DeclareTopology declares the queues shared by the API and the workers.
+func DeclareTopology(ch *amqp.Channel) error {
+	queues := []struct {
+		name string
+		args amqp.Table
+	}{
+		{JobQueue, amqp.Table{"x-max-priority": int32(MaxPriority)}},
+		{LegacyJobQueue, nil},
+		{DeadLetterQueue, nil},
+	}
+	for _, q := range queues {
+		_, err := ch.QueueDeclare(
+			q.name, // name
+			true,   // durable
+			false,  // delete when unused
+			false,  // exclusive
+			false,  // no-wait
+			q.args, // arguments
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+// Package ratelimit shares the Google Maps request rates between worker
+// replicas and the API's lookups through a token bucket per endpoint stored
+// in PostgreSQL.
+//
+// To avoid a round trip per call, each worker leases a tenth of a second of
+// tokens at a time and spends them locally; leased tokens expire after a
+// second so a worker cannot save them up. While PostgreSQL is unreachable
+// each worker falls back to an in-process bucket with its share of the rate.
+package ratelimit
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"processador-de-enderecos/pkg/googlemaps"
+)
+
+const (
+	// leaseSeconds is how many seconds of tokens a worker takes at once.
+	leaseSeconds = 0.1
+	// leaseTTL is how long leased tokens stay usable.
+	leaseTTL = time.Second
+	// fallbackPeriod is how long the local limiter is used after the
+	// shared bucket could not be reached.
+	fallbackPeriod = 5 * time.Second
+)
+
+// Postgres is a googlemaps.Limiter shared by every process using the same
+// database.
+type Postgres struct {
+	db       *sqlx.DB
+	rates    googlemaps.Rates
+	fallback googlemaps.Limiter
+	logger   *slog.Logger
+	leases   map[googlemaps.Endpoint]*lease
+
+	mu sync.Mutex
+	// fallbackUntil is when the shared bucket is tried again.
+	fallbackUntil time.Time
+}
+
+// lease holds the tokens a worker took from a shared bucket. Its mutex is
+// held while refilling, so a single caller per endpoint waits on the bucket.
+type lease struct {
+	mu      sync.Mutex
+	tokens  float64
+	expires time.Time
+}
+
+// NewPostgres returns a limiter enforcing rates across all the processes
+// sharing db. replicas is the number of processes expected to share them:
+// while the database is unreachable each one allows rates/replicas.
+func NewPostgres(db *sqlx.DB, rates googlemaps.Rates, replicas int, logger *slog.Logger) *Postgres {
+	l := &Postgres{
+		db:       db,
+		rates:    rates,
+		fallback: googlemaps.NewLocalLimiter(rates.Scale(1 / float64(max(replicas, 1)))),
+		logger:   logger,
+		leases:   make(map[googlemaps.Endpoint]*lease),
+	}
+	for endpoint := range rates {
+		l.leases[endpoint] = &lease{}
+	}
+	return l
+}
+
+// Wait blocks until a call to endpoint is allowed. Endpoints without a rate
+// are not limited.
+func (l *Postgres) Wait(ctx context.Context, endpoint googlemaps.Endpoint) error {
+	ls, ok := l.leases[endpoint]
+	if !ok {
+		return nil
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for {
+		l.mu.Lock()
+		fallback := time.Now().Before(l.fallbackUntil)
+		l.mu.Unlock()
+		if fallback {
+			return l.fallback.Wait(ctx, endpoint)
+		}
+
+		if ls.tokens >= 1 && time.Now().Before(ls.expires) {
+			ls.tokens--
+			return nil
+		}
+
+		rate := l.rates[endpoint]
+		granted, wait, err := l.take(ctx, endpoint, math.Max(1, math.Floor(rate*leaseSeconds)))
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			l.logger.Warn("Shared rate limiter unavailable, using local limiter", "endpoint", endpoint, "error", err, "retry_in", fallbackPeriod)
+			l.mu.Lock()
+			l.fallbackUntil = time.Now().Add(fallbackPeriod)
+			l.mu.Unlock()
+			continue
+		}
+		if granted > 0 {
+			ls.tokens, ls.expires = granted, time.Now().Add(leaseTTL)
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// take refills the shared bucket of endpoint for the time elapsed since it
+// was last used, then takes up to want whole tokens from it. When none is
+// available it returns how long until one is.
+func (l *Postgres) take(ctx context.Context, endpoint googlemaps.Endpoint, want float64) (float64, time.Duration, error) {
+	rate := l.rates[endpoint]
+	burst := math.Max(1, rate)
+	name := "google_maps:" + string(endpoint)
+
+	tx, err := l.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO rate_limits (name, tokens, updated_at) VALUES ($1, $2, clock_timestamp()) ON CONFLICT (name) DO NOTHING", name, burst)
+	if err != nil {
+		return 0, 0, err
+	}
+	var bucket struct {
+		Tokens  float64 `db:"tokens"`
+		Elapsed float64 `db:"elapsed"`
+	}
+	err = tx.GetContext(ctx, &bucket, "SELECT tokens, EXTRACT(EPOCH FROM clock_timestamp() - updated_at) AS elapsed FROM rate_limits WHERE name = $1 FOR UPDATE", name)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tokens := math.Min(burst, bucket.Tokens+math.Max(0, bucket.Elapsed)*rate)
+	granted := math.Min(want, math.Floor(tokens))
+	tokens -= granted
+	if _, err := tx.ExecContext(ctx, "UPDATE rate_limits SET tokens = $1, updated_at = clock_timestamp() WHERE name = $2", tokens, name); err != nil {
+		return 0, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+
+	var wait time.Duration
+	if granted == 0 {
+		wait = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	return granted, wait, nil
+}
@@ -0,0 +1,99 @@
+// Package scheduler runs the jobs received by a worker with a fixed
+// concurrency, sharing it fairly between tenants: pending jobs are kept in
+// one FIFO per tenant and the tenants take turns, so a tenant with many
+// queued jobs does not delay the others by more than one job per slot.
+package scheduler
+
+import "sync"
+
+// Fair runs submitted tasks round-robin across tenants.
+type Fair struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// queues holds the pending tasks of each tenant; ring lists the tenants
+	// with pending tasks in the order they get their next turn.
+	queues map[string][]func()
+	ring   []string
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewFair starts a scheduler running at most workers tasks at once.
+func NewFair(workers int) *Fair {
+	f := &Fair{queues: make(map[string][]func())}
+	f.cond = sync.NewCond(&f.mu)
+	f.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go f.run()
+	}
+	return f
+}
+
+// Submit queues task for tenant. It returns false if the scheduler is
+// closed and the task will not run.
+func (f *Fair) Submit(tenant string, task func()) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return false
+	}
+	if len(f.queues[tenant]) == 0 {
+		f.ring = append(f.ring, tenant)
+	}
+	f.queues[tenant] = append(f.queues[tenant], task)
+	f.cond.Signal()
+	return true
+}
+
+// Close stops accepting tasks, discards the queued ones and waits for the
+// running ones to finish. It returns the number of tasks discarded.
+func (f *Fair) Close() int {
+	f.mu.Lock()
+	f.closed = true
+	discarded := 0
+	for _, q := range f.queues {
+		discarded += len(q)
+	}
+	f.queues = make(map[string][]func())
+	f.ring = nil
+	f.cond.Broadcast()
+	f.mu.Unlock()
+	f.wg.Wait()
+	return discarded
+}
+
+func (f *Fair) run() {
+	defer f.wg.Done()
+	for {
+		task, ok := f.next()
+		if !ok {
+			return
+		}
+		task()
+	}
+}
+
+// next waits for a task and takes it from the tenant at the head of the
+// ring, which then moves to the back if it has more.
+func (f *Fair) next() (func(), bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.ring) == 0 {
+		if f.closed {
+			return nil, false
+		}
+		f.cond.Wait()
+	}
+
+	tenant := f.ring[0]
+	f.ring = f.ring[1:]
+	q := f.queues[tenant]
+	task := q[0]
+	if len(q) > 1 {
+		f.queues[tenant] = q[1:]
+		f.ring = append(f.ring, tenant)
+	} else {
+		delete(f.queues, tenant)
+	}
+	return task, true
+}
@@ -0,0 +1,107 @@
+package scheduler
+
+import (
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestFairRoundRobin(t *testing.T) {
+	tests := []struct {
+		name  string
+		tasks []string // tenant of each task, in submission order
+		want  []string
+	}{
+		{
+			name:  "single tenant keeps its order",
+			tasks: []string{"a", "a", "a"},
+			want:  []string{"a1", "a2", "a3"},
+		},
+		{
+			name:  "tenants take turns",
+			tasks: []string{"a", "a", "a", "b", "b", "c"},
+			want:  []string{"a1", "b1", "c1", "a2", "b2", "a3"},
+		},
+		{
+			name:  "late tenant joins the end of the ring",
+			tasks: []string{"a", "b", "a", "b", "c", "a"},
+			want:  []string{"a1", "b1", "c1", "a2", "b2", "a3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFair(1)
+			defer f.Close()
+
+			// Hold the only worker so every task is queued before any runs.
+			started, release := make(chan struct{}), make(chan struct{})
+			f.Submit("blocker", func() {
+				close(started)
+				<-release
+			})
+			<-started
+
+			var mu sync.Mutex
+			var got []string
+			var wg sync.WaitGroup
+			counts := map[string]int{}
+			for _, tenant := range tt.tasks {
+				counts[tenant]++
+				name := tenant + string(rune('0'+counts[tenant]))
+				wg.Add(1)
+				f.Submit(tenant, func() {
+					mu.Lock()
+					got = append(got, name)
+					mu.Unlock()
+					wg.Done()
+				})
+			}
+			close(release)
+			wg.Wait()
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ran %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFairClose(t *testing.T) {
+	f := NewFair(1)
+	started, release := make(chan struct{}), make(chan struct{})
+	finished := false
+	f.Submit("a", func() {
+		close(started)
+		<-release
+		finished = true
+	})
+	<-started
+	for i := 0; i < 3; i++ {
+		f.Submit("b", func() { t.Error("queued task ran after Close") })
+	}
+
+	closed := make(chan int)
+	go func() { closed <- f.Close() }()
+	// Release the running task once Close stopped the scheduler, so the
+	// worker does not pick up a queued task first.
+	for {
+		f.mu.Lock()
+		stopped := f.closed
+		f.mu.Unlock()
+		if stopped {
+			break
+		}
+		runtime.Gosched()
+	}
+	close(release)
+	if discarded := <-closed; discarded != 3 {
+		t.Errorf("Close() = %d, want 3 discarded tasks", discarded)
+	}
+	if !finished {
+		t.Error("Close() returned before the running task finished")
+	}
+	if f.Submit("a", func() {}) {
+		t.Error("Submit() after Close() = true, want false")
+	}
+}
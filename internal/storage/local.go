@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Local stores objects as files under <dir>/<bucket>. Presigned URLs point
+// to the API, which serves them with LocalHandler.
+type Local struct {
+	dir       string
+	bucket    string
+	prefix    string
+	publicURL string
+	secret    []byte
+}
+
+// NewLocal returns a store for bucket, creating its directory.
+func NewLocal(dir, bucket, prefix, publicURL string, secret []byte) (*Local, error) {
+	if err := os.MkdirAll(filepath.Join(dir, bucket), 0o750); err != nil {
+		return nil, err
+	}
+	return &Local{dir: dir, bucket: bucket, prefix: prefix, publicURL: strings.TrimRight(publicURL, "/"), secret: secret}, nil
+}
+
+func openLocal(cfg Config) (Store, Store, error) {
+	if cfg.Secret == "" {
+		return nil, nil, errors.New("STORAGE_SECRET is required by the local storage backend")
+	}
+	uploads, err := NewLocal(cfg.Dir, cfg.UploadsBucket, cfg.Prefix, cfg.PublicURL, []byte(cfg.Secret))
+	if err != nil {
+		return nil, nil, err
+	}
+	results, err := NewLocal(cfg.Dir, cfg.ResultsBucket, cfg.Prefix, cfg.PublicURL, []byte(cfg.Secret))
+	if err != nil {
+		return nil, nil, err
+	}
+	return uploads, results, nil
+}
+
+// objectPath maps a key to a file, rejecting keys that escape the bucket.
+func objectPath(dir, bucket, key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" || clean != "/"+key {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(dir, bucket, filepath.FromSlash(clean)), nil
+}
+
+func (s *Local) path(key string) (string, error) {
+	return objectPath(s.dir, s.bucket, s.prefix+key)
+}
+
+func (s *Local) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (ObjectInfo, error) {
+	name, err := s.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return writeFile(name, r, -1)
+}
+
+// writeFile writes r to name through a temporary file, so readers never see
+// a partial object. limit caps the size when positive.
+func writeFile(name string, r io.Reader, limit int64) (ObjectInfo, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0o750); err != nil {
+		return ObjectInfo{}, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".upload-*")
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if limit > 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	// The MD5 hex digest matches the ETag S3 gives single-part uploads.
+	h := md5.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if limit > 0 && n > limit {
+		return ObjectInfo{}, errTooLarge
+	}
+	if err := tmp.Close(); err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Size: n, ETag: hex.EncodeToString(h.Sum(nil)), LastModified: time.Now()}, nil
+}
+
+var errTooLarge = errors.New("object exceeds the size limit")
+
+func (s *Local) Get(ctx context.Context, key string) (Object, error) {
+	name, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, mapFileError(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &localObject{File: f, info: fileInfo(key, fi)}, nil
+}
+
+func (s *Local) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	name, err := s.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return ObjectInfo{}, mapFileError(err)
+	}
+	return fileInfo(key, fi), nil
+}
+
+func (s *Local) Delete(ctx context.Context, key string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *Local) PresignGet(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	return s.presign(http.MethodGet, key, expiry)
+}
+
+func (s *Local) PresignPut(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	return s.presign(http.MethodPut, key, expiry)
+}
+
+func (s *Local) presign(method, key string, expiry time.Duration) (string, error) {
+	if _, err := s.path(key); err != nil {
+		return "", err
+	}
+	objectKey := s.bucket + "/" + s.prefix + key
+	expires := strconv.FormatInt(time.Now().Add(expiry).Unix(), 10)
+	q := url.Values{}
+	q.Set("expires", expires)
+	q.Set("signature", sign(s.secret, method, objectKey, expires))
+	return s.publicURL + "/files/" + objectKey + "?" + q.Encode(), nil
+}
+
+// sign computes the signature of a local file URL.
+func sign(secret []byte, method, objectKey, expires string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + objectKey + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// LocalHandler serves the presigned URLs of the local backend: GET downloads
+// and PUT uploads of at most maxPutBytes. It expects paths of the form
+// /<bucket>/<key>, so it is usually mounted with http.StripPrefix("/files").
+func LocalHandler(dir string, secret []byte, maxPutBytes int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		objectKey := strings.TrimPrefix(r.URL.Path, "/")
+		bucket, key, ok := strings.Cut(objectKey, "/")
+		if !ok || bucket == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodPut {
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		expires := r.URL.Query().Get("expires")
+		unix, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil || time.Now().Unix() > unix {
+			http.Error(w, "URL expired", http.StatusForbidden)
+			return
+		}
+		expected := sign(secret, r.Method, objectKey, expires)
+		if !hmac.Equal([]byte(expected), []byte(r.URL.Query().Get("signature"))) {
+			http.Error(w, "invalid signature", http.StatusForbidden)
+			return
+		}
+
+		name, err := objectPath(dir, bucket, key)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			info, err := writeFile(name, r.Body, maxPutBytes)
+			if errors.Is(err, errTooLarge) {
+				http.Error(w, "object exceeds the size limit", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				http.Error(w, "failed to store object", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("ETag", `"`+info.ETag+`"`)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		f, err := os.Open(name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil || fi.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		if ct := mime.TypeByExtension(path.Ext(name)); ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
+		http.ServeContent(w, r, path.Base(name), fi.ModTime(), f)
+	})
+}
+
+func fileInfo(key string, fi os.FileInfo) ObjectInfo {
+	return ObjectInfo{Key: key, Size: fi.Size(), LastModified: fi.ModTime()}
+}
+
+func mapFileError(err error) error {
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+	return err
+}
+
+type localObject struct {
+	*os.File
+	info ObjectInfo
+}
+
+func (o *localObject) Info() ObjectInfo {
+	return o.info
+}
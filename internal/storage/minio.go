@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// MinIO stores objects in a MinIO or S3 bucket.
+type MinIO struct {
+	client *minio.Client
+	// presign signs URLs for the public endpoint, which may differ from the
+	// endpoint the services use.
+	presign *minio.Client
+	bucket  string
+	prefix  string
+}
+
+// NewMinIO returns a store for bucket. presign may be nil to sign URLs with
+// client.
+func NewMinIO(client, presign *minio.Client, bucket, prefix string) *MinIO {
+	if presign == nil {
+		presign = client
+	}
+	return &MinIO{client: client, presign: presign, bucket: bucket, prefix: prefix}
+}
+
+func openMinIO(cfg Config) (Store, Store, error) {
+	creds := credentials.NewStaticV4(cfg.AccessKeyID, cfg.SecretAccessKey, "")
+	client, err := minio.New(cfg.Endpoint, &minio.Options{Creds: creds, Secure: cfg.UseSSL, Region: cfg.Region})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var presign *minio.Client
+	if cfg.PublicEndpoint != "" {
+		u, err := url.Parse(cfg.PublicEndpoint)
+		if err != nil || u.Host == "" {
+			return nil, nil, fmt.Errorf("invalid MINIO_PUBLIC_ENDPOINT %q", cfg.PublicEndpoint)
+		}
+		// Setting the region keeps the client from looking up the bucket
+		// location, since the public endpoint is often unreachable from
+		// inside the network.
+		presign, err = minio.New(u.Host, &minio.Options{Creds: creds, Secure: u.Scheme == "https", Region: cfg.Region})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return NewMinIO(client, presign, cfg.UploadsBucket, cfg.Prefix), NewMinIO(client, presign, cfg.ResultsBucket, cfg.Prefix), nil
+}
+
+func (s *MinIO) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (ObjectInfo, error) {
+	opts := minio.PutObjectOptions{ContentType: contentType}
+	if size < 0 {
+		opts.PartSize = PartSize
+	}
+	info, err := s.client.PutObject(ctx, s.bucket, s.prefix+key, r, size, opts)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: info.Size, ETag: info.ETag, ContentType: contentType, LastModified: info.LastModified}, nil
+}
+
+func (s *MinIO) Get(ctx context.Context, key string) (Object, error) {
+	object, err := s.client.GetObject(ctx, s.bucket, s.prefix+key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, mapError(err)
+	}
+	// GetObject is lazy; Stat surfaces a missing object before reading.
+	info, err := object.Stat()
+	if err != nil {
+		object.Close()
+		return nil, mapError(err)
+	}
+	return &minioObject{Object: object, info: s.objectInfo(key, info)}, nil
+}
+
+func (s *MinIO) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, s.prefix+key, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, mapError(err)
+	}
+	return s.objectInfo(key, info), nil
+}
+
+func (s *MinIO) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, s.prefix+key, minio.RemoveObjectOptions{})
+}
+
+func (s *MinIO) PresignGet(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	u, err := s.presign.PresignedGetObject(ctx, s.bucket, s.prefix+key, expiry, nil)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func (s *MinIO) PresignPut(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	u, err := s.presign.PresignedPutObject(ctx, s.bucket, s.prefix+key, expiry)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func (s *MinIO) objectInfo(key string, info minio.ObjectInfo) ObjectInfo {
+	return ObjectInfo{Key: key, Size: info.Size, ETag: info.ETag, ContentType: info.ContentType, LastModified: info.LastModified}
+}
+
+func mapError(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchBucket":
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+	return err
+}
+
+type minioObject struct {
+	*minio.Object
+	info ObjectInfo
+}
+
+func (o *minioObject) Info() ObjectInfo {
+	return o.info
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ErrNotFound is returned when an object does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	ContentType  string
+	LastModified time.Time
+}
+
+// Object is an open stored object. ReadAt allows random access, which zip
+// inputs need.
+type Object interface {
+	io.Reader
+	io.ReaderAt
+	io.Closer
+	Info() ObjectInfo
+}
+
+// PartSize is the size of the parts objects of unknown size are uploaded in
+// by multipart-capable stores. Fixing it lets writers compute the ETag of
+// such an upload, the MD5 of the parts' MD5s, while streaming.
+const PartSize = 16 << 20
+
+// Store keeps the objects of one bucket. Keys are the paths recorded on the
+// jobs rows, e.g. "uploads/<job>.csv"; a store may prepend a prefix to them.
+type Store interface {
+	// Put stores r under key. size is -1 when unknown, in which case the
+	// object may be uploaded in parts of PartSize bytes.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (ObjectInfo, error)
+	// Get opens an object, returning ErrNotFound if it does not exist.
+	Get(ctx context.Context, key string) (Object, error)
+	// Stat describes an object, returning ErrNotFound if it does not exist.
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// Delete removes an object. Missing objects are not an error.
+	Delete(ctx context.Context, key string) error
+	// PresignGet returns a URL that downloads the object until expiry.
+	PresignGet(ctx context.Context, key string, expiry time.Duration) (string, error)
+	// PresignPut returns a URL that uploads the object with PUT until expiry.
+	PresignPut(ctx context.Context, key string, expiry time.Duration) (string, error)
+}
+
+// Config selects and configures the storage backend.
+type Config struct {
+	// Backend is "minio" (the default, also for S3) or "local".
+	Backend       string
+	UploadsBucket string
+	ResultsBucket string
+	// Prefix is prepended to every key, e.g. to share a bucket between
+	// environments.
+	Prefix string
+
+	// MinIO/S3
+	Endpoint        string
+	AccessKeyID     string
+	SecretAccessKey string
+	UseSSL          bool
+	Region          string
+	// PublicEndpoint is the URL clients use to reach MinIO, e.g.
+	// http://localhost:9000. Presigned URLs are signed for this host.
+	PublicEndpoint string
+
+	// Local directory
+	Dir string
+	// PublicURL is the base URL of the API serving the local files.
+	PublicURL string
+	// Secret signs the URLs of local files.
+	Secret string
+}
+
+// ConfigFromEnv reads the storage configuration from the environment.
+func ConfigFromEnv() Config {
+	useSSL, _ := strconv.ParseBool(os.Getenv("MINIO_USE_SSL"))
+	return Config{
+		Backend:         envOr("STORAGE_BACKEND", "minio"),
+		UploadsBucket:   envOr("STORAGE_UPLOADS_BUCKET", "uploads"),
+		ResultsBucket:   envOr("STORAGE_RESULTS_BUCKET", "results"),
+		Prefix:          os.Getenv("STORAGE_PREFIX"),
+		Endpoint:        os.Getenv("MINIO_ENDPOINT"),
+		AccessKeyID:     os.Getenv("MINIO_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("MINIO_SECRET_ACCESS_KEY"),
+		UseSSL:          useSSL,
+		Region:          envOr("MINIO_REGION", "us-east-1"),
+		PublicEndpoint:  os.Getenv("MINIO_PUBLIC_ENDPOINT"),
+		Dir:             envOr("STORAGE_DIR", "/data"),
+		PublicURL:       os.Getenv("STORAGE_PUBLIC_URL"),
+		Secret:          os.Getenv("STORAGE_SECRET"),
+	}
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// Open returns the stores for uploaded inputs and for job results.
+func Open(cfg Config) (uploads, results Store, err error) {
+	switch cfg.Backend {
+	case "minio", "s3":
+		return openMinIO(cfg)
+	case "local":
+		return openLocal(cfg)
+	default:
+		return nil, nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
@@ -0,0 +1,179 @@
+package googlemaps
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// throttleFactor and slowFactor multiply the rate of an endpoint after
+	// an OVER_QUERY_LIMIT response or a latency spike.
+	throttleFactor = 0.5
+	slowFactor     = 0.8
+	// increaseStep is the fraction of the maximum rate added after each
+	// healthy increaseInterval.
+	increaseStep     = 0.05
+	increaseInterval = time.Second
+	// decreaseCooldown keeps the responses to requests already in flight
+	// from lowering the rate again right after a decrease.
+	decreaseCooldown = time.Second
+	// minRateFraction is the lowest fraction of the maximum rate allowed.
+	minRateFraction = 0.05
+	// A latency spike is a response slower than spikeFactor times the
+	// average latency, and at least minSpike.
+	spikeFactor = 3
+	minSpike    = 500 * time.Millisecond
+	// latencyWeight is the weight of each response in the average latency.
+	latencyWeight = 0.1
+)
+
+// AdaptiveLimiter adjusts the rate of each endpoint to how Google responds,
+// additive increase / multiplicative decrease: the rate is halved after an
+// OVER_QUERY_LIMIT response, lowered after a latency spike, and raised
+// slowly back towards the configured rate while responses are healthy.
+// Calls it allows are then paced by the next limiter, e.g. one shared by all
+// workers.
+type AdaptiveLimiter struct {
+	next      Limiter
+	endpoints map[Endpoint]*aimd
+}
+
+// aimd is the controller of one endpoint.
+type aimd struct {
+	limiter *rate.Limiter
+
+	mu             sync.Mutex
+	max, min, qps  float64
+	latency        time.Duration
+	lastIncrease   time.Time
+	lastDecrease   time.Time
+	overQueryLimit int64
+	latencySpikes  int64
+}
+
+// NewAdaptiveLimiter returns a limiter that starts at rates and never goes
+// above them.
+func NewAdaptiveLimiter(next Limiter, rates Rates) *AdaptiveLimiter {
+	a := &AdaptiveLimiter{next: next, endpoints: make(map[Endpoint]*aimd)}
+	for endpoint, qps := range rates {
+		a.endpoints[endpoint] = &aimd{
+			limiter: rate.NewLimiter(rate.Limit(qps), int(math.Ceil(qps))),
+			max:     qps,
+			min:     qps * minRateFraction,
+			qps:     qps,
+		}
+	}
+	return a
+}
+
+// Wait blocks until both the endpoint's current rate and the next limiter
+// allow a call.
+func (a *AdaptiveLimiter) Wait(ctx context.Context, endpoint Endpoint) error {
+	if c, ok := a.endpoints[endpoint]; ok {
+		if err := c.limiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	return a.next.Wait(ctx, endpoint)
+}
+
+// Observe adjusts the rate of endpoint after a call. Errors other than
+// OVER_QUERY_LIMIT, such as network errors, leave the rate unchanged.
+func (a *AdaptiveLimiter) Observe(endpoint Endpoint, latency time.Duration, err error) {
+	c, ok := a.endpoints[endpoint]
+	if !ok {
+		return
+	}
+	var apiErr *APIError
+	if err != nil && !errors.As(err, &apiErr) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if IsOverQueryLimit(err) {
+		c.overQueryLimit++
+		c.decrease(now, throttleFactor)
+		return
+	}
+
+	spike := c.latency > 0 && latency > spikeFactor*c.latency && latency > minSpike
+	if c.latency == 0 {
+		c.latency = latency
+	} else {
+		c.latency += time.Duration(latencyWeight * float64(latency-c.latency))
+	}
+	if spike {
+		c.latencySpikes++
+		c.decrease(now, slowFactor)
+		return
+	}
+	if c.qps < c.max && now.Sub(c.lastIncrease) >= increaseInterval && now.Sub(c.lastDecrease) >= increaseInterval {
+		c.set(math.Min(c.max, c.qps+c.max*increaseStep))
+		c.lastIncrease = now
+	}
+}
+
+func (c *aimd) decrease(now time.Time, factor float64) {
+	if now.Sub(c.lastDecrease) < decreaseCooldown {
+		return
+	}
+	c.set(math.Max(c.min, c.qps*factor))
+	c.lastDecrease = now
+}
+
+func (c *aimd) set(qps float64) {
+	c.qps = qps
+	c.limiter.SetLimit(rate.Limit(qps))
+	c.limiter.SetBurst(int(math.Ceil(qps)))
+}
+
+// EndpointStats is the state of the controller of an endpoint.
+type EndpointStats struct {
+	QPS            float64 `json:"qps"`
+	MaxQPS         float64 `json:"max_qps"`
+	LatencyMS      float64 `json:"latency_ms"`
+	OverQueryLimit int64   `json:"over_query_limit"`
+	LatencySpikes  int64   `json:"latency_spikes"`
+}
+
+// Stats returns the state of every endpoint.
+func (a *AdaptiveLimiter) Stats() map[Endpoint]EndpointStats {
+	stats := make(map[Endpoint]EndpointStats, len(a.endpoints))
+	for endpoint, c := range a.endpoints {
+		c.mu.Lock()
+		stats[endpoint] = EndpointStats{
+			QPS:            c.qps,
+			MaxQPS:         c.max,
+			LatencyMS:      float64(c.latency) / float64(time.Millisecond),
+			OverQueryLimit: c.overQueryLimit,
+			LatencySpikes:  c.latencySpikes,
+		}
+		c.mu.Unlock()
+	}
+	return stats
+}
+
+// CurrentRates returns the rate currently allowed to each endpoint.
+func (a *AdaptiveLimiter) CurrentRates() Rates {
+	rates := Rates{}
+	for endpoint, s := range a.Stats() {
+		rates[endpoint] = s.QPS
+	}
+	return rates
+}
+
+// CurrentRates returns the rates currently allowed by the client's limiter,
+// or nil if it does not adapt them.
+func (c *Client) CurrentRates() Rates {
+	if a, ok := c.limiter.(*AdaptiveLimiter); ok {
+		return a.CurrentRates()
+	}
+	return nil
+}
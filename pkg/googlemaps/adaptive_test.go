@@ -0,0 +1,164 @@
+package googlemaps
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveLimiterObserve(t *testing.T) {
+	const maxQPS = 100
+	overQueryLimit := &APIError{Endpoint: EndpointGeocode, Status: StatusOverQueryLimit}
+	zeroResults := &APIError{Endpoint: EndpointGeocode, Status: "ZERO_RESULTS"}
+	long := 10 * time.Second
+
+	tests := []struct {
+		name string
+		// Controller state before the call. sinceIncrease and sinceDecrease
+		// are how long ago the rate last changed.
+		qps           float64
+		latency       time.Duration
+		sinceIncrease time.Duration
+		sinceDecrease time.Duration
+		// The observed call.
+		callLatency time.Duration
+		err         error
+
+		wantQPS    float64
+		wantOQL    int64
+		wantSpikes int64
+	}{
+		{
+			name: "over query limit halves the rate",
+			qps:  maxQPS, sinceIncrease: long, sinceDecrease: long,
+			callLatency: 50 * time.Millisecond, err: overQueryLimit,
+			wantQPS: 50, wantOQL: 1,
+		},
+		{
+			name: "wrapped over query limit",
+			qps:  80, sinceIncrease: long, sinceDecrease: long,
+			err:     errors.Join(errors.New("geocoding"), overQueryLimit),
+			wantQPS: 40, wantOQL: 1,
+		},
+		{
+			name: "decrease cooldown",
+			qps:  50, sinceIncrease: long, sinceDecrease: decreaseCooldown / 2,
+			err:     overQueryLimit,
+			wantQPS: 50, wantOQL: 1,
+		},
+		{
+			name: "rate never goes below the minimum",
+			qps:  maxQPS * minRateFraction * 1.5, sinceIncrease: long, sinceDecrease: long,
+			err:     overQueryLimit,
+			wantQPS: maxQPS * minRateFraction, wantOQL: 1,
+		},
+		{
+			name: "latency spike lowers the rate",
+			qps:  maxQPS, latency: 100 * time.Millisecond, sinceIncrease: long, sinceDecrease: long,
+			callLatency: time.Second,
+			wantQPS:     maxQPS * slowFactor, wantSpikes: 1,
+		},
+		{
+			name: "slow call under the spike minimum",
+			qps:  maxQPS, latency: 10 * time.Millisecond, sinceIncrease: long, sinceDecrease: long,
+			callLatency: minSpike - time.Millisecond,
+			wantQPS:     maxQPS,
+		},
+		{
+			name: "healthy call raises the rate by a step",
+			qps:  50, latency: 100 * time.Millisecond, sinceIncrease: long, sinceDecrease: long,
+			callLatency: 100 * time.Millisecond,
+			wantQPS:     50 + maxQPS*increaseStep,
+		},
+		{
+			name: "API errors other than over query limit count as healthy",
+			qps:  50, latency: 100 * time.Millisecond, sinceIncrease: long, sinceDecrease: long,
+			callLatency: 100 * time.Millisecond, err: zeroResults,
+			wantQPS: 50 + maxQPS*increaseStep,
+		},
+		{
+			name: "increase is capped at the configured rate",
+			qps:  maxQPS - 1, latency: 100 * time.Millisecond, sinceIncrease: long, sinceDecrease: long,
+			callLatency: 100 * time.Millisecond,
+			wantQPS:     maxQPS,
+		},
+		{
+			name: "one increase per interval",
+			qps:  50, latency: 100 * time.Millisecond, sinceIncrease: increaseInterval / 2, sinceDecrease: long,
+			callLatency: 100 * time.Millisecond,
+			wantQPS:     50,
+		},
+		{
+			name: "no increase right after a decrease",
+			qps:  50, latency: 100 * time.Millisecond, sinceIncrease: long, sinceDecrease: increaseInterval / 2,
+			callLatency: 100 * time.Millisecond,
+			wantQPS:     50,
+		},
+		{
+			name: "network errors leave the rate unchanged",
+			qps:  50, sinceIncrease: long, sinceDecrease: long,
+			callLatency: 5 * time.Second, err: errors.New("connection reset"),
+			wantQPS: 50,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAdaptiveLimiter(NewLocalLimiter(nil), Rates{EndpointGeocode: maxQPS})
+			c := a.endpoints[EndpointGeocode]
+			now := time.Now()
+			c.set(tt.qps)
+			c.latency = tt.latency
+			c.lastIncrease = now.Add(-tt.sinceIncrease)
+			c.lastDecrease = now.Add(-tt.sinceDecrease)
+
+			a.Observe(EndpointGeocode, tt.callLatency, tt.err)
+
+			stats := a.Stats()[EndpointGeocode]
+			if math.Abs(stats.QPS-tt.wantQPS) > 1e-9 {
+				t.Errorf("QPS = %v, want %v", stats.QPS, tt.wantQPS)
+			}
+			if stats.OverQueryLimit != tt.wantOQL {
+				t.Errorf("OverQueryLimit = %d, want %d", stats.OverQueryLimit, tt.wantOQL)
+			}
+			if stats.LatencySpikes != tt.wantSpikes {
+				t.Errorf("LatencySpikes = %d, want %d", stats.LatencySpikes, tt.wantSpikes)
+			}
+			if limit := float64(c.limiter.Limit()); math.Abs(limit-tt.wantQPS) > 1e-9 {
+				t.Errorf("limiter rate = %v, want %v", limit, tt.wantQPS)
+			}
+		})
+	}
+}
+
+func TestAdaptiveLimiterRecovers(t *testing.T) {
+	const maxQPS = 100
+	a := NewAdaptiveLimiter(NewLocalLimiter(nil), Rates{EndpointGeocode: maxQPS})
+	c := a.endpoints[EndpointGeocode]
+
+	a.Observe(EndpointGeocode, 0, &APIError{Endpoint: EndpointGeocode, Status: StatusOverQueryLimit})
+	want := float64(maxQPS) * throttleFactor
+	steps := 0
+	for c.qps < maxQPS {
+		// Pretend an increase interval has passed since the last change.
+		c.lastIncrease = c.lastIncrease.Add(-2 * increaseInterval)
+		c.lastDecrease = c.lastDecrease.Add(-2 * increaseInterval)
+		a.Observe(EndpointGeocode, 10*time.Millisecond, nil)
+		want = math.Min(maxQPS, want+maxQPS*increaseStep)
+		if math.Abs(c.qps-want) > 1e-9 {
+			t.Fatalf("step %d: QPS = %v, want %v", steps, c.qps, want)
+		}
+		steps++
+	}
+	if wantSteps := int(math.Ceil((1 - throttleFactor) / increaseStep)); steps != wantSteps {
+		t.Errorf("recovered in %d steps, want %d", steps, wantSteps)
+	}
+}
+
+func TestAdaptiveLimiterUnknownEndpoint(t *testing.T) {
+	a := NewAdaptiveLimiter(NewLocalLimiter(nil), Rates{EndpointGeocode: 10})
+	a.Observe(EndpointPlaceDetails, time.Second, &APIError{Endpoint: EndpointPlaceDetails, Status: StatusOverQueryLimit})
+	if _, ok := a.Stats()[EndpointPlaceDetails]; ok {
+		t.Error("Stats() has an endpoint without a rate")
+	}
+}
@@ -3,23 +3,24 @@ package googlemaps
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 	"time"
-
-	"golang.org/x/time/rate"
 )
 
 // Client holds the necessary components for interacting with the Google Maps API.
 type Client struct {
 	apiKey     string
 	httpClient *http.Client
-	limiter    *rate.Limiter
+	limiter    Limiter
 }
 
-// NewClient creates a new Google Maps client.
-func NewClient(apiKey string, limiter *rate.Limiter) *Client {
+// NewClient creates a new Google Maps client whose calls are paced by
+// limiter. If limiter is also an Observer, it is told the outcome and latency
+// of every call.
+func NewClient(apiKey string, limiter Limiter) *Client {
 	return &Client{
 		apiKey: apiKey,
 		httpClient: &http.Client{
@@ -29,6 +30,64 @@ func NewClient(apiKey string, limiter *rate.Limiter) *Client {
 	}
 }
 
+// StatusOverQueryLimit is the status of responses refused because the
+// project's request rate or quota was exceeded.
+const StatusOverQueryLimit = "OVER_QUERY_LIMIT"
+
+// APIError is returned when an API answers with an error status.
+type APIError struct {
+	Endpoint Endpoint
+	Status   string
+}
+
+func (e *APIError) Error() string {
+	switch e.Endpoint {
+	case EndpointGeocode:
+		return "geocoding API error: " + e.Status
+	case EndpointNearbySearch:
+		return "nearby search API error: " + e.Status
+	default:
+		return "place Details API error: " + e.Status
+	}
+}
+
+// IsOverQueryLimit reports whether err is an OVER_QUERY_LIMIT response.
+func IsOverQueryLimit(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Status == StatusOverQueryLimit
+}
+
+// Observer is told the outcome of every API call, e.g. to adapt the request
+// rate to how the API responds.
+type Observer interface {
+	Observe(endpoint Endpoint, latency time.Duration, err error)
+}
+
+// do sends req and decodes the JSON response into v, reporting the outcome
+// to the limiter if it observes calls. check returns the API error of a
+// decoded response.
+func (c *Client) do(req *http.Request, endpoint Endpoint, v any, check func() error) error {
+	start := time.Now()
+	err := c.send(req, v, check)
+	if o, ok := c.limiter.(Observer); ok {
+		o.Observe(endpoint, time.Since(start), err)
+	}
+	return err
+}
+
+func (c *Client) send(req *http.Request, v any, check func() error) error {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return err
+	}
+	return check()
+}
+
 // --- Geocoding API Structures ---
 
 // GeocodeResult represents a single result from the Geocoding API.
@@ -65,9 +124,10 @@ type NearbySearchResponse struct {
 
 // Place represents a single place found by Nearby Search.
 type Place struct {
-	PlaceID string   `json:"place_id"`
-	Name    string   `json:"name"`
-	Types   []string `json:"types"`
+	PlaceID  string   `json:"place_id"`
+	Name     string   `json:"name"`
+	Types    []string `json:"types"`
+	Geometry Geometry `json:"geometry"`
 }
 
 // --- Place Details API Structures ---
@@ -90,7 +150,7 @@ type PlaceDetailsResult struct {
 
 // Geocode converts an address into a Place ID and metadata using the Geocoding API.
 func (c *Client) Geocode(ctx context.Context, address string) (*GeocodeResponse, error) {
-	if err := c.limiter.Wait(ctx); err != nil {
+	if err := c.limiter.Wait(ctx, EndpointGeocode); err != nil {
 		return nil, err
 	}
 
@@ -104,27 +164,23 @@ func (c *Client) Geocode(ctx context.Context, address string) (*GeocodeResponse,
 	q.Add("key", c.apiKey)
 	req.URL.RawQuery = q.Encode()
 
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
 	var result GeocodeResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	err = c.do(req, EndpointGeocode, &result, func() error {
+		if result.Status != "OK" && result.Status != "ZERO_RESULTS" {
+			return &APIError{Endpoint: EndpointGeocode, Status: result.Status}
+		}
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	if result.Status != "OK" && result.Status != "ZERO_RESULTS" {
-		return nil, fmt.Errorf("geocoding API error: %s", result.Status)
-	}
-
 	return &result, nil
 }
 
 // NearbySearch finds places within a specified area.
 func (c *Client) NearbySearch(ctx context.Context, lat, lng float64, radius uint) (*NearbySearchResponse, error) {
-	if err := c.limiter.Wait(ctx); err != nil {
+	if err := c.limiter.Wait(ctx, EndpointNearbySearch); err != nil {
 		return nil, err
 	}
 
@@ -139,28 +195,23 @@ func (c *Client) NearbySearch(ctx context.Context, lat, lng float64, radius uint
 	q.Add("key", c.apiKey)
 	req.URL.RawQuery = q.Encode()
 
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
 	var result NearbySearchResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	err = c.do(req, EndpointNearbySearch, &result, func() error {
+		if result.Status != "OK" && result.Status != "ZERO_RESULTS" {
+			return &APIError{Endpoint: EndpointNearbySearch, Status: result.Status}
+		}
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	if result.Status != "OK" && result.Status != "ZERO_RESULTS" {
-		return nil, fmt.Errorf("nearby search API error: %s", result.Status)
-	}
-
 	return &result, nil
 }
 
-
 // GetPlaceDetails gets detailed information about a place using its Place ID.
 func (c *Client) GetPlaceDetails(ctx context.Context, placeID string) (*PlaceDetailsResult, error) {
-	if err := c.limiter.Wait(ctx); err != nil {
+	if err := c.limiter.Wait(ctx, EndpointPlaceDetails); err != nil {
 		return nil, err
 	}
 
@@ -175,20 +226,16 @@ func (c *Client) GetPlaceDetails(ctx context.Context, placeID string) (*PlaceDet
 	q.Add("key", c.apiKey)
 	req.URL.RawQuery = q.Encode()
 
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
 	var result PlaceDetailsResult
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	err = c.do(req, EndpointPlaceDetails, &result, func() error {
+		if result.Status != "OK" {
+			return &APIError{Endpoint: EndpointPlaceDetails, Status: result.Status}
+		}
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	if result.Status != "OK" {
-		return nil, fmt.Errorf("place Details API error: %s", result.Status)
-	}
-
 	return &result, nil
 }
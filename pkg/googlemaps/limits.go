@@ -0,0 +1,91 @@
+package googlemaps
+
+import (
+	"context"
+	"math"
+	"os"
+	"strconv"
+
+	"golang.org/x/time/rate"
+)
+
+// Limiter paces the calls made to each endpoint.
+type Limiter interface {
+	// Wait blocks until a call to endpoint is allowed or ctx is done.
+	Wait(ctx context.Context, endpoint Endpoint) error
+}
+
+// Rates holds the calls per second allowed to each endpoint.
+type Rates map[Endpoint]float64
+
+// DefaultRates stays under Google's default per-API quotas.
+var DefaultRates = Rates{
+	EndpointGeocode:      50,
+	EndpointNearbySearch: 50,
+	EndpointPlaceDetails: 50,
+}
+
+// RatesFromEnv returns the default rates overridden by the MAPS_QPS_GEOCODE,
+// MAPS_QPS_NEARBY_SEARCH and MAPS_QPS_PLACE_DETAILS environment variables.
+func RatesFromEnv() Rates {
+	rates := Rates{}
+	for endpoint, qps := range DefaultRates {
+		rates[endpoint] = qps
+	}
+	envVars := map[Endpoint]string{
+		EndpointGeocode:      "MAPS_QPS_GEOCODE",
+		EndpointNearbySearch: "MAPS_QPS_NEARBY_SEARCH",
+		EndpointPlaceDetails: "MAPS_QPS_PLACE_DETAILS",
+	}
+	for endpoint, name := range envVars {
+		if v, err := strconv.ParseFloat(os.Getenv(name), 64); err == nil && v > 0 {
+			rates[endpoint] = v
+		}
+	}
+	return rates
+}
+
+// Scale returns the rates multiplied by f.
+func (r Rates) Scale(f float64) Rates {
+	scaled := Rates{}
+	for endpoint, qps := range r {
+		scaled[endpoint] = qps * f
+	}
+	return scaled
+}
+
+// localLimiter holds one in-process token bucket per endpoint.
+type localLimiter map[Endpoint]*rate.Limiter
+
+// NewLocalLimiter returns a Limiter with an in-process token bucket for each
+// endpoint of rates, with a burst of one second of calls. Endpoints without
+// a rate are not limited.
+func NewLocalLimiter(rates Rates) Limiter {
+	l := localLimiter{}
+	for endpoint, qps := range rates {
+		l[endpoint] = rate.NewLimiter(rate.Limit(qps), int(math.Ceil(qps)))
+	}
+	return l
+}
+
+func (l localLimiter) Wait(ctx context.Context, endpoint Endpoint) error {
+	if limiter, ok := l[endpoint]; ok {
+		return limiter.Wait(ctx)
+	}
+	return nil
+}
+
+// sharedLimiter paces every endpoint with the same token bucket.
+type sharedLimiter struct {
+	limiter *rate.Limiter
+}
+
+// SharedLimiter returns a Limiter that paces the calls to all endpoints
+// together with l.
+func SharedLimiter(l *rate.Limiter) Limiter {
+	return sharedLimiter{limiter: l}
+}
+
+func (l sharedLimiter) Wait(ctx context.Context, _ Endpoint) error {
+	return l.limiter.Wait(ctx)
+}
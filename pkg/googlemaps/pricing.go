@@ -0,0 +1,108 @@
+package googlemaps
+
+import (
+	"os"
+	"strconv"
+	"sync/atomic"
+)
+
+// Endpoint identifies a billable Google Maps API endpoint.
+type Endpoint string
+
+const (
+	EndpointGeocode      Endpoint = "geocode"
+	EndpointNearbySearch Endpoint = "nearby_search"
+	EndpointPlaceDetails Endpoint = "place_details"
+)
+
+// CallCounts is a snapshot of the number of calls made to each endpoint.
+type CallCounts struct {
+	Geocode      int64 `json:"geocode"`
+	NearbySearch int64 `json:"nearby_search"`
+	PlaceDetails int64 `json:"place_details"`
+}
+
+// Total returns the number of calls across all endpoints.
+func (c CallCounts) Total() int64 {
+	return c.Geocode + c.NearbySearch + c.PlaceDetails
+}
+
+// Plus returns the sum of c and o.
+func (c CallCounts) Plus(o CallCounts) CallCounts {
+	return CallCounts{
+		Geocode:      c.Geocode + o.Geocode,
+		NearbySearch: c.NearbySearch + o.NearbySearch,
+		PlaceDetails: c.PlaceDetails + o.PlaceDetails,
+	}
+}
+
+// Usage counts calls per endpoint. It is safe for concurrent use.
+type Usage struct {
+	geocode      atomic.Int64
+	nearbySearch atomic.Int64
+	placeDetails atomic.Int64
+}
+
+// Add records one call to the given endpoint.
+func (u *Usage) Add(endpoint Endpoint) {
+	switch endpoint {
+	case EndpointGeocode:
+		u.geocode.Add(1)
+	case EndpointNearbySearch:
+		u.nearbySearch.Add(1)
+	case EndpointPlaceDetails:
+		u.placeDetails.Add(1)
+	}
+}
+
+// Counts returns a snapshot of the recorded calls.
+func (u *Usage) Counts() CallCounts {
+	return CallCounts{
+		Geocode:      u.geocode.Load(),
+		NearbySearch: u.nearbySearch.Load(),
+		PlaceDetails: u.placeDetails.Load(),
+	}
+}
+
+// PriceTable holds the price in USD per 1000 calls of each endpoint.
+type PriceTable map[Endpoint]float64
+
+// DefaultPriceTable uses Google's list prices for the SKUs the pipeline calls.
+var DefaultPriceTable = PriceTable{
+	EndpointGeocode:      5.00,
+	EndpointNearbySearch: 32.00,
+	EndpointPlaceDetails: 17.00,
+}
+
+// PriceTableFromEnv returns the default price table overridden by the
+// MAPS_PRICE_GEOCODE, MAPS_PRICE_NEARBY_SEARCH and MAPS_PRICE_PLACE_DETAILS
+// environment variables (USD per 1000 calls).
+func PriceTableFromEnv() PriceTable {
+	prices := PriceTable{}
+	for endpoint, price := range DefaultPriceTable {
+		prices[endpoint] = price
+	}
+	envVars := map[Endpoint]string{
+		EndpointGeocode:      "MAPS_PRICE_GEOCODE",
+		EndpointNearbySearch: "MAPS_PRICE_NEARBY_SEARCH",
+		EndpointPlaceDetails: "MAPS_PRICE_PLACE_DETAILS",
+	}
+	for endpoint, name := range envVars {
+		if v, err := strconv.ParseFloat(os.Getenv(name), 64); err == nil && v >= 0 {
+			prices[endpoint] = v
+		}
+	}
+	return prices
+}
+
+// Price returns the cost in USD of a single call to the endpoint.
+func (p PriceTable) Price(endpoint Endpoint) float64 {
+	return p[endpoint] / 1000
+}
+
+// Cost returns the cost in USD of the given calls.
+func (p PriceTable) Cost(c CallCounts) float64 {
+	return float64(c.Geocode)*p.Price(EndpointGeocode) +
+		float64(c.NearbySearch)*p.Price(EndpointNearbySearch) +
+		float64(c.PlaceDetails)*p.Price(EndpointPlaceDetails)
+}